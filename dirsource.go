@@ -0,0 +1,329 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// snapshotFile is an outages file in a directory or archive.
+type snapshotFile struct {
+	name       string // slash separated, relative to the archive root
+	modTime    time.Time
+	observedAt time.Time
+}
+
+// snapshotArchive is a directory or archive of outages files.
+type snapshotArchive interface {
+	// list returns the regular files in the archive, with observedAt
+	// unset.
+	list() ([]snapshotFile, error)
+	// each calls fn with the contents of each of files, in order.
+	each(files []snapshotFile, fn func(snapshotFile, io.Reader) error) error
+	io.Closer
+}
+
+// dirSource calls consume with each outages file in the directory, tar
+// or zip archive at path observed after resume, oldest first. Only
+// files ending in .json are read.
+//
+// If layout is set, each file's observation time is parsed from its
+// base name using layout, eg "outages-20060102T150405Z.json", otherwise
+// its modification time is used. Times are truncated to the second, as
+// they're stored, and only the first file by name in each second is
+// read. Like gitSource, files with the same contents as the previous
+// one are skipped.
+func dirSource(ctx context.Context, path, layout string, resume ingestState, consume func(context.Context, snapshot, io.Reader) error) error {
+	ar, err := openSnapshotArchive(path)
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+
+	all, err := ar.list()
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", path, err)
+	}
+
+	var files []snapshotFile
+	for _, f := range all {
+		base := filepath.Base(f.name)
+		if !strings.HasSuffix(base, ".json") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		f.observedAt = f.modTime.UTC()
+		if layout != "" {
+			f.observedAt, err = time.Parse(layout, base)
+			if err != nil {
+				return fmt.Errorf("observation time of %s: %w", f.name, err)
+			}
+		}
+		f.observedAt = f.observedAt.Truncate(time.Second)
+		if !f.observedAt.After(resume.ObservedAt) {
+			continue
+		}
+		files = append(files, f)
+	}
+
+	slices.SortFunc(files, func(a, b snapshotFile) int {
+		if c := a.observedAt.Compare(b.observedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.name, b.name)
+	})
+
+	log.Println("dirSource reading", len(files), "files from", path)
+
+	lastBlob := resume.Blob
+	var last snapshotFile
+	return ar.each(files, func(f snapshotFile, r io.Reader) error {
+		// Stop between snapshots when ctx is done.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if f.observedAt.Equal(last.observedAt) {
+			log.Println("dirSource skipping", f.name, "observed in the same second as", last.name)
+			return nil
+		}
+		last = f
+
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", f.name, err)
+		}
+
+		// Same as git's, so snapshots archived from either source
+		// are shared.
+		blob := plumbing.ComputeHash(plumbing.BlobObject, b).String()
+		if blob == lastBlob {
+			return nil
+		}
+		lastBlob = blob
+
+		if err := consume(ctx, snapshot{ObservedAt: f.observedAt, Source: "dir", Blob: blob}, bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		return nil
+	})
+}
+
+func openSnapshotArchive(p string) (snapshotArchive, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return dirArchive{root: p}, nil
+	}
+
+	switch {
+	case strings.HasSuffix(p, ".zip"):
+		zr, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, err
+		}
+		return zipArchive{zr}, nil
+	case strings.HasSuffix(p, ".tar"):
+		return tarArchive{path: p}, nil
+	case strings.HasSuffix(p, ".tar.gz"), strings.HasSuffix(p, ".tgz"):
+		return tarArchive{path: p, gzipped: true}, nil
+	}
+	return nil, fmt.Errorf("%s is not a directory, zip or tar archive", p)
+}
+
+type dirArchive struct {
+	root string
+}
+
+func (d dirArchive) list() ([]snapshotFile, error) {
+	var files []snapshotFile
+	err := filepath.WalkDir(d.root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil || !de.Type().IsRegular() {
+			return err
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, snapshotFile{name: filepath.ToSlash(rel), modTime: fi.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+func (d dirArchive) each(files []snapshotFile, fn func(snapshotFile, io.Reader) error) error {
+	for _, sf := range files {
+		if err := d.one(sf, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d dirArchive) one(sf snapshotFile, fn func(snapshotFile, io.Reader) error) error {
+	f, err := os.Open(filepath.Join(d.root, filepath.FromSlash(sf.name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(sf, f)
+}
+
+func (dirArchive) Close() error { return nil }
+
+type zipArchive struct {
+	*zip.ReadCloser
+}
+
+func (z zipArchive) list() ([]snapshotFile, error) {
+	var files []snapshotFile
+	for _, f := range z.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, snapshotFile{name: path.Clean(f.Name), modTime: f.Modified})
+	}
+	return files, nil
+}
+
+func (z zipArchive) each(files []snapshotFile, fn func(snapshotFile, io.Reader) error) error {
+	byName := make(map[string]*zip.File, len(z.File))
+	for _, f := range z.File {
+		byName[path.Clean(f.Name)] = f
+	}
+	for _, sf := range files {
+		if err := z.one(byName[sf.name], sf, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z zipArchive) one(zf *zip.File, sf snapshotFile, fn func(snapshotFile, io.Reader) error) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return fn(sf, r)
+}
+
+// tarArchive reads a possibly gzipped tar file. Tar files can only be
+// read in order, so each reads the file once, holding files that are
+// needed later than they appear in memory. Archives of files in time
+// order don't need any held.
+type tarArchive struct {
+	path    string
+	gzipped bool
+}
+
+func (t tarArchive) list() ([]snapshotFile, error) {
+	var files []snapshotFile
+	err := t.walk(func(hdr *tar.Header, _ io.Reader) error {
+		files = append(files, snapshotFile{name: path.Clean(hdr.Name), modTime: hdr.ModTime})
+		return nil
+	})
+	return files, err
+}
+
+func (t tarArchive) each(files []snapshotFile, fn func(snapshotFile, io.Reader) error) error {
+	order := make(map[string]int, len(files))
+	for i, f := range files {
+		order[f.name] = i
+	}
+
+	next := 0
+	held := make(map[int][]byte)
+	err := t.walk(func(hdr *tar.Header, r io.Reader) error {
+		i, ok := order[path.Clean(hdr.Name)]
+		if !ok {
+			return nil
+		}
+		if i != next {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			held[i] = b
+			return nil
+		}
+
+		if err := fn(files[i], r); err != nil {
+			return err
+		}
+		next++
+		for b, ok := held[next]; ok; b, ok = held[next] {
+			delete(held, next)
+			if err := fn(files[next], bytes.NewReader(b)); err != nil {
+				return err
+			}
+			next++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if next != len(files) {
+		return fmt.Errorf("%s: did not see %s", t.path, files[next].name)
+	}
+	return nil
+}
+
+// walk calls fn with each regular file in the archive.
+func (t tarArchive) walk(fn func(*tar.Header, io.Reader) error) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if t.gzipped {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (tarArchive) Close() error { return nil }
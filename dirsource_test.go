@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/go-cmp/cmp"
+)
+
+type testFile struct {
+	name     string
+	contents string
+	modTime  time.Time
+}
+
+func writeTestDir(t *testing.T, files []testFile) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f.contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func writeTestTar(t *testing.T, files []testFile) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "snapshots.tar.gz")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, tf := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: tf.name, Mode: 0o644, Size: int64(len(tf.contents)), ModTime: tf.modTime, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, tf.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func writeTestZip(t *testing.T, files []testFile) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "snapshots.zip")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, zf := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: zf.name, Modified: zf.modTime, Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, zf.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func collectDirSource(path, layout string, resume ingestState) ([]consumed, error) {
+	var got []consumed
+	err := dirSource(context.Background(), path, layout, resume, func(_ context.Context, s snapshot, r io.Reader) error {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if s.Source != "dir" || s.Blob != plumbing.ComputeHash(plumbing.BlobObject, b).String() {
+			return io.ErrUnexpectedEOF
+		}
+		got = append(got, consumed{ObservedAt: s.ObservedAt, Outages: string(b)})
+		return nil
+	})
+	return got, err
+}
+
+func TestDirSource(t *testing.T) {
+	t1 := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	t3 := t2.Add(time.Minute)
+	t4 := t3.Add(time.Minute)
+
+	// Out of time order, with mod times that disagree with the names.
+	files := []testFile{
+		{"2021/outages-20210118T193600Z.json", `[{"id":"b"}]`, t1},
+		{"2021/outages-20210118T193400Z.json", `[{"id":"a"}]`, t3},
+		{"README.md", `not outages`, t1},
+		{"2021/outages-20210118T193500Z.json", `[{"id":"b"}]`, t4},
+		{"2021/outages-20210118T193700Z.json", `[]`, t2},
+	}
+	const layout = "outages-20060102T150405Z.json"
+
+	writers := []struct {
+		name  string
+		write func(*testing.T, []testFile) string
+	}{
+		{"dir", writeTestDir},
+		{"tar", writeTestTar},
+		{"zip", writeTestZip},
+	}
+
+	cases := []struct {
+		name    string
+		layout  string
+		resume  ingestState
+		want    []consumed
+		wantErr string
+	}{
+		{
+			name:   "layout",
+			layout: layout,
+			want: []consumed{
+				{t1, "", `[{"id":"a"}]`},
+				{t2, "", `[{"id":"b"}]`},
+				{t4, "", `[]`},
+			},
+		},
+		{
+			name:   "layout resuming",
+			layout: layout,
+			resume: ingestState{ObservedAt: t2, Blob: plumbing.ComputeHash(plumbing.BlobObject, []byte(`[{"id":"b"}]`)).String()},
+			want: []consumed{
+				{t4, "", `[]`},
+			},
+		},
+		{
+			name: "mod time",
+			want: []consumed{
+				{t1, "", `[{"id":"b"}]`},
+				{t2, "", `[]`},
+				{t3, "", `[{"id":"a"}]`},
+				{t4, "", `[{"id":"b"}]`},
+			},
+		},
+		{
+			name:   "mod time resuming",
+			resume: ingestState{ObservedAt: t2},
+			want: []consumed{
+				{t3, "", `[{"id":"a"}]`},
+				{t4, "", `[{"id":"b"}]`},
+			},
+		},
+		{
+			name:    "bad layout",
+			layout:  "20060102.json",
+			wantErr: "observation time of 2021/outages-",
+		},
+	}
+
+	for _, w := range writers {
+		path := w.write(t, files)
+		for _, tc := range cases {
+			t.Run(w.name+"/"+tc.name, func(t *testing.T) {
+				got, err := collectDirSource(path, tc.layout, tc.resume)
+				if tc.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+						t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if d := cmp.Diff(tc.want, got, cmp.Comparer(func(a, b time.Time) bool { return a.Equal(b) })); d != "" {
+					t.Errorf("consumed mismatch (-want +got):\n%s", d)
+				}
+			})
+		}
+	}
+}
+
+func TestDirSourceSameSecond(t *testing.T) {
+	t1 := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+
+	// As if copied without keeping mod times.
+	path := writeTestDir(t, []testFile{
+		{"a.json", `[{"id":"a"}]`, t1.Add(200 * time.Millisecond)},
+		{"b.json", `[{"id":"b"}]`, t1.Add(700 * time.Millisecond)},
+		{"c.json", `[{"id":"c"}]`, t1.Add(1200 * time.Millisecond)},
+	})
+
+	cases := []struct {
+		name   string
+		resume ingestState
+		want   []consumed
+	}{
+		{
+			name: "first in each second",
+			want: []consumed{
+				{t1, "", `[{"id":"a"}]`},
+				{t1.Add(time.Second), "", `[{"id":"c"}]`},
+			},
+		},
+		{
+			name:   "resuming in the same second",
+			resume: ingestState{ObservedAt: t1, Blob: plumbing.ComputeHash(plumbing.BlobObject, []byte(`[{"id":"a"}]`)).String()},
+			want: []consumed{
+				{t1.Add(time.Second), "", `[{"id":"c"}]`},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := collectDirSource(path, "", tc.resume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("consumed mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
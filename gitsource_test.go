@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/google/go-cmp/cmp"
+)
+
+type testCommit struct {
+	when    time.Time
+	outages string
+}
+
+// testRepo returns an in-memory repo with a commit of
+// data/outages.json for each of commits, and the commits' hashes.
+func testRepo(t *testing.T, commits []testCommit) (*git.Repository, []string) {
+	t.Helper()
+
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes []string
+	for i, c := range commits {
+		if err := util.WriteFile(fs, "data/outages.json", []byte(c.outages), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add("data/outages.json"); err != nil {
+			t.Fatal(err)
+		}
+		sig := &object.Signature{Name: "scraper", Email: "scraper@example.com", When: c.when}
+		h, err := wt.Commit("update "+strings.Repeat("x", i), &git.CommitOptions{Author: sig, Committer: sig, AllowEmptyCommits: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h.String())
+	}
+
+	return repo, hashes
+}
+
+type consumed struct {
+	ObservedAt time.Time
+	Commit     string
+	Outages    string
+}
+
+func collectGitSource(repo *git.Repository, revs gitRange, resume ingestState) ([]consumed, error) {
+	var got []consumed
+	err := gitSource(context.Background(), func(context.Context) (*git.Repository, error) { return repo, nil }, "data/outages.json", revs, resume, func(_ context.Context, s snapshot, r io.Reader) error {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		got = append(got, consumed{ObservedAt: s.ObservedAt, Commit: s.Commit, Outages: string(b)})
+		return nil
+	})
+	return got, err
+}
+
+func TestGitSourceResume(t *testing.T) {
+	t1 := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	t3 := t2.Add(time.Minute)
+
+	repo, hashes := testRepo(t, []testCommit{
+		{t1, `[{"id":"a"}]`},
+		{t2, `[{"id":"b"}]`},
+		// Shares a timestamp with the previous commit.
+		{t2, `[{"id":"c"}]`},
+		// Same outages file as the previous commit.
+		{t3, `[{"id":"c"}]`},
+		{t3.Add(time.Minute), `[]`},
+	})
+
+	blob := func(i int) string {
+		t.Helper()
+		c, err := repo.CommitObject(plumbing.NewHash(hashes[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := c.File("data/outages.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.Hash.String()
+	}
+
+	cases := []struct {
+		name    string
+		resume  ingestState
+		want    []consumed
+		wantErr string
+	}{
+		{
+			name:   "from start",
+			resume: ingestState{},
+			want: []consumed{
+				{t1, hashes[0], `[{"id":"a"}]`},
+				{t2, hashes[1], `[{"id":"b"}]`},
+				{t2, hashes[2], `[{"id":"c"}]`},
+				{t3.Add(time.Minute), hashes[4], `[]`},
+			},
+		},
+		{
+			name:   "commit sharing a timestamp",
+			resume: ingestState{Commit: hashes[1], Blob: blob(1), ObservedAt: t2},
+			want: []consumed{
+				{t2, hashes[2], `[{"id":"c"}]`},
+				{t3.Add(time.Minute), hashes[4], `[]`},
+			},
+		},
+		{
+			name:   "commit with unchanged file after",
+			resume: ingestState{Commit: hashes[2], Blob: blob(2), ObservedAt: t2},
+			want: []consumed{
+				{t3.Add(time.Minute), hashes[4], `[]`},
+			},
+		},
+		{
+			name:   "rewritten falls back to time",
+			resume: ingestState{Commit: strings.Repeat("1", 40), ObservedAt: t1},
+			want: []consumed{
+				{t2, hashes[1], `[{"id":"b"}]`},
+				{t2, hashes[2], `[{"id":"c"}]`},
+				{t3.Add(time.Minute), hashes[4], `[]`},
+			},
+		},
+		{
+			name:    "rewritten without time",
+			resume:  ingestState{Commit: strings.Repeat("1", 40), ObservedAt: t1.Add(time.Second)},
+			wantErr: "did not see since commit",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := collectGitSource(repo, gitRange{}, tc.resume)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("consumed mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+// TestGitSourceSharedTimestampObserve ingests commits sharing a
+// timestamp into a store, which keeps only the first of them.
+func TestGitSourceSharedTimestampObserve(t *testing.T) {
+	t1 := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	t3 := t2.Add(time.Minute)
+
+	a := `{"desc":{"cause":"Trees On Line","etr":"","start":""},"geom":{"lon":1,"lat":1}}`
+	a2 := `{"desc":{"cause":"Under Investigation","etr":"","start":""},"geom":{"lon":1,"lat":1}}`
+	b := `{"desc":{"cause":"Trees On Line","etr":"","start":""},"geom":{"lon":2,"lat":2}}`
+	repo, hashes := testRepo(t, []testCommit{
+		{t1, "[" + a + "]"},
+		{t2, "[" + a2 + "]"},
+		// a is in both t2 commits, so can't have an event from each.
+		{t2.Add(500 * time.Millisecond), "[" + a + "," + b + "]"},
+	})
+
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ingest := func() {
+		t.Helper()
+		tr := newOutageTracker(st, lonLatMatcher{})
+		if err := tr.loadState(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		resume, err := st.ingestState(t.Context(), "git")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = gitSource(t.Context(), func(context.Context) (*git.Repository, error) { return repo, nil }, "data/outages.json", gitRange{}, resume, func(ctx context.Context, s snapshot, r io.Reader) error {
+			var outages []outage
+			if err := json.NewDecoder(r).Decode(&outages); err != nil {
+				return err
+			}
+			return tr.observe(ctx, s, outages)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := func() []string {
+		t.Helper()
+		rows, err := db.Query("select outage_id || ' ' || observed_at || ' ' || event || ' ' || cause from outage_events order by 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var e string
+			if err := rows.Scan(&e); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, e)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	ingest()
+	want := []string{
+		"1 2021-01-18T19:34:00Z Initial Trees On Line",
+		"1 2021-01-18T19:35:00Z Update Under Investigation",
+	}
+	if d := cmp.Diff(want, events()); d != "" {
+		t.Errorf("events mismatch (-want +got):\n%s", d)
+	}
+
+	// Resuming skips the later t2 commit again.
+	ingest()
+	if d := cmp.Diff(want, events()); d != "" {
+		t.Errorf("events after resuming mismatch (-want +got):\n%s", d)
+	}
+
+	// And picks up from the next commit.
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := util.WriteFile(wt.Filesystem, "data/outages.json", []byte("["+b+"]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("data/outages.json"); err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "scraper", Email: "scraper@example.com", When: t3}
+	if _, err := wt.Commit("update", &git.CommitOptions{Author: sig, Committer: sig}); err != nil {
+		t.Fatal(err)
+	}
+	ingest()
+	want = append(want,
+		"1 2021-01-18T19:36:00Z Missing Under Investigation",
+		"2 2021-01-18T19:36:00Z Initial Trees On Line",
+	)
+	if d := cmp.Diff(want, events()); d != "" {
+		t.Errorf("events after next commit mismatch (-want +got):\n%s", d)
+	}
+
+	var commit string
+	if err := db.QueryRow("select commit_hash from observations order by id desc limit 1").Scan(&commit); err != nil {
+		t.Fatal(err)
+	}
+	if commit == hashes[2] {
+		t.Error("skipped commit was recorded as an observation")
+	}
+}
+
+// testRemote returns the path of an on-disk repo to use as a remote and
+// a func to commit outages to it.
+func testRemote(t *testing.T) (string, func(outages string) plumbing.Hash) {
+	t.Helper()
+	if _, err := exec.LookPath("git-upload-pack"); err != nil {
+		t.Skip("need git-upload-pack to serve a local remote")
+	}
+
+	remoteDir := t.TempDir()
+	remote, err := git.PlainInit(remoteDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := remote.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	commit := func(outages string) plumbing.Hash {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(remoteDir, "data"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(remoteDir, "data", "outages.json"), []byte(outages), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add("data/outages.json"); err != nil {
+			t.Fatal(err)
+		}
+		when = when.Add(time.Minute)
+		sig := &object.Signature{Name: "scraper", Email: "scraper@example.com", When: when}
+		h, err := wt.Commit("update", &git.CommitOptions{Author: sig, Committer: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	return remoteDir, commit
+}
+
+// testHead returns the head of the repo returned by openRepo.
+func testHead(t *testing.T, openRepo func(context.Context) (*git.Repository, error)) plumbing.Hash {
+	t.Helper()
+	repo, err := openRepo(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.Hash()
+}
+
+func TestRemoteOpenRepo(t *testing.T) {
+	remoteDir, commit := testRemote(t)
+	openRepo := remoteOpenRepo(remoteDir)
+
+	h1 := commit(`[]`)
+	if got := testHead(t, openRepo); got != h1 {
+		t.Errorf("got head %v after clone, want %v", got, h1)
+	}
+
+	h2 := commit(`[{"id":"a"}]`)
+	if got := testHead(t, openRepo); got != h2 {
+		t.Errorf("got head %v after fetch, want %v", got, h2)
+	}
+	if got := testHead(t, openRepo); got != h2 {
+		t.Errorf("got head %v when up to date, want %v", got, h2)
+	}
+}
+
+func TestCachedOpenRepo(t *testing.T) {
+	remoteDir, commit := testRemote(t)
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	openRepo := cachedOpenRepo(remoteDir, cacheDir)
+	head := func() plumbing.Hash {
+		t.Helper()
+		return testHead(t, openRepo)
+	}
+
+	h1 := commit(`[]`)
+	if got := head(); got != h1 {
+		t.Errorf("got head %v after clone, want %v", got, h1)
+	}
+
+	h2 := commit(`[{"id":"a"}]`)
+	if got := head(); got != h2 {
+		t.Errorf("got head %v after fetch, want %v", got, h2)
+	}
+	if got := head(); got != h2 {
+		t.Errorf("got head %v when up to date, want %v", got, h2)
+	}
+
+	if err := os.RemoveAll(filepath.Join(cacheDir, "objects")); err != nil {
+		t.Fatal(err)
+	}
+	if got := head(); got != h2 {
+		t.Errorf("got head %v after corruption, want %v", got, h2)
+	}
+
+	_, err := cachedOpenRepo("https://example.com/other.git", cacheDir)(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "not https://example.com/other.git") {
+		t.Errorf("got error %v opening cache of another remote", err)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "objects")); err != nil {
+		t.Errorf("cache of another remote was removed: %v", err)
+	}
+}
+
+func TestCachedOpenRepoNotCache(t *testing.T) {
+	remoteDir, _ := testRemote(t)
+
+	// A repo with no origin, such as a checkout of the data.
+	dir, commit := testRemote(t)
+	h := commit(`[]`)
+
+	_, err := cachedOpenRepo(remoteDir, dir)(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "has no origin remote") {
+		t.Errorf("got error %v opening repo without an origin", err)
+	}
+
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatalf("repo without an origin was removed: %v", err)
+	}
+	if got, err := repo.Head(); err != nil || got.Hash() != h {
+		t.Errorf("got head %v, %v after opening repo without an origin, want %v", got, err, h)
+	}
+}
+
+func TestGitSourceRange(t *testing.T) {
+	t1 := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	t3 := t2.Add(time.Minute)
+	t4 := t3.Add(time.Minute)
+
+	repo, hashes := testRepo(t, []testCommit{
+		{t1, `[{"id":"a"}]`},
+		{t2, `[{"id":"b"}]`},
+		// Same outages file as the previous commit.
+		{t3, `[{"id":"b"}]`},
+		{t4, `[]`},
+	})
+	if _, err := repo.CreateTag("storm", plumbing.NewHash(hashes[1]), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		revs    gitRange
+		resume  ingestState
+		want    []consumed
+		wantErr string
+	}{
+		{
+			name: "to commit",
+			revs: gitRange{To: hashes[1]},
+			want: []consumed{
+				{t1, hashes[0], `[{"id":"a"}]`},
+				{t2, hashes[1], `[{"id":"b"}]`},
+			},
+		},
+		{
+			name: "from tag",
+			revs: gitRange{From: "storm"},
+			want: []consumed{
+				{t4, hashes[3], `[]`},
+			},
+		},
+		{
+			name: "from and to",
+			revs: gitRange{From: hashes[0], To: "storm"},
+			want: []consumed{
+				{t2, hashes[1], `[{"id":"b"}]`},
+			},
+		},
+		{
+			name:   "from ignored when resuming",
+			revs:   gitRange{From: "storm"},
+			resume: ingestState{Commit: hashes[0]},
+			want: []consumed{
+				{t2, hashes[1], `[{"id":"b"}]`},
+				{t4, hashes[3], `[]`},
+			},
+		},
+		{
+			name:    "from after to",
+			revs:    gitRange{From: hashes[2], To: hashes[1]},
+			wantErr: "is not in the history of",
+		},
+		{
+			name:    "unknown to",
+			revs:    gitRange{To: "nope"},
+			wantErr: `resolving to revision "nope"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := collectGitSource(repo, tc.revs, tc.resume)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("consumed mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestGitSourceCanceled(t *testing.T) {
+	t1 := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	repo, hashes := testRepo(t, []testCommit{
+		{t1, `[{"id":"a"}]`},
+		{t1.Add(time.Minute), `[{"id":"b"}]`},
+		{t1.Add(2 * time.Minute), `[]`},
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var got []string
+	err := gitSource(ctx, func(context.Context) (*git.Repository, error) { return repo, nil }, "data/outages.json", gitRange{}, ingestState{}, func(_ context.Context, s snapshot, r io.Reader) error {
+		got = append(got, s.Commit)
+		if len(got) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if d := cmp.Diff(hashes[:2], got); d != "" {
+		t.Errorf("consumed commits mismatch (-want +got):\n%s", d)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// httpSource fetches the outages file at url every interval until ctx
+// is done, calling consume with each payload that differs from the
+// previous one, observed at the time it was fetched. Unchanged payloads
+// are skipped using the ETag header if the server sends one, and by
+// content hash, starting with resume.Blob.
+//
+// Failed fetches are logged and retried at the next interval, only
+// errors from consume or ctx stop polling.
+func httpSource(ctx context.Context, client *http.Client, url string, interval time.Duration, resume ingestState, consume func(context.Context, snapshot, io.Reader) error) error {
+	p := httpPoller{client: client, url: url, lastBlob: resume.Blob, lastAt: resume.ObservedAt, now: time.Now}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if err := p.poll(ctx, consume); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+type httpPoller struct {
+	client   *http.Client
+	url      string
+	now      func() time.Time
+	etag     string
+	lastBlob string
+	lastAt   time.Time
+}
+
+func (p *httpPoller) poll(ctx context.Context, consume func(context.Context, snapshot, io.Reader) error) error {
+	// RFC3339 storage only keeps seconds, and events are keyed by
+	// time, so wait until a later second than the last snapshot.
+	fetchedAt := p.now().UTC().Truncate(time.Second)
+	if !fetchedAt.After(p.lastAt) {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Println("httpSource fetching", p.url, "failed:", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil
+	default:
+		log.Println("httpSource fetching", p.url, "got status", resp.Status)
+		return nil
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Println("httpSource reading", p.url, "failed:", err)
+		return nil
+	}
+	p.etag = resp.Header.Get("ETag")
+
+	// Same as git's, so snapshots archived from any source are
+	// shared.
+	blob := plumbing.ComputeHash(plumbing.BlobObject, b).String()
+	if blob == p.lastBlob {
+		return nil
+	}
+
+	if err := consume(ctx, snapshot{ObservedAt: fetchedAt, Source: "http", Blob: blob}, bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("payload fetched at %v: %w", fetchedAt, err)
+	}
+	p.lastBlob, p.lastAt = blob, fetchedAt
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/go-cmp/cmp"
+)
+
+// testFeed stands in for the upstream outage feed, serving body until
+// it's changed, with an ETag if etags is set.
+type testFeed struct {
+	etags bool
+
+	mu           sync.Mutex
+	status       int
+	body         string
+	notModifieds int
+}
+
+func (f *testFeed) set(status int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.body = status, body
+}
+
+func (f *testFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.status != http.StatusOK {
+		w.WriteHeader(f.status)
+		return
+	}
+	if f.etags {
+		etag := fmt.Sprintf("%q", plumbing.ComputeHash(plumbing.BlobObject, []byte(f.body)).String())
+		if r.Header.Get("If-None-Match") == etag {
+			f.notModifieds++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+	}
+	io.WriteString(w, f.body)
+}
+
+func TestHTTPPoller(t *testing.T) {
+	t1 := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	empty := plumbing.ComputeHash(plumbing.BlobObject, []byte(`[]`)).String()
+
+	type step struct {
+		at     time.Time
+		status int
+		body   string
+	}
+	steps := []step{
+		{t1, http.StatusOK, `[]`},
+		// Changed within the same second as the last snapshot, so
+		// not fetched until the next step.
+		{t1.Add(500 * time.Millisecond), http.StatusOK, `[{"id":"a"}]`},
+		{t1.Add(time.Minute), http.StatusOK, `[{"id":"a"}]`},
+		{t1.Add(2 * time.Minute), http.StatusInternalServerError, ""},
+		{t1.Add(3 * time.Minute), http.StatusOK, `[{"id":"a"}]`},
+		{t1.Add(4 * time.Minute), http.StatusOK, `[]`},
+	}
+
+	cases := []struct {
+		name             string
+		etags            bool
+		resume           ingestState
+		want             []consumed
+		wantNotModifieds int
+	}{
+		{
+			name: "content hash",
+			want: []consumed{
+				{t1, "", `[]`},
+				{t1.Add(time.Minute), "", `[{"id":"a"}]`},
+				{t1.Add(4 * time.Minute), "", `[]`},
+			},
+		},
+		{
+			name:  "etag",
+			etags: true,
+			want: []consumed{
+				{t1, "", `[]`},
+				{t1.Add(time.Minute), "", `[{"id":"a"}]`},
+				{t1.Add(4 * time.Minute), "", `[]`},
+			},
+			wantNotModifieds: 1,
+		},
+		{
+			name:   "resuming",
+			resume: ingestState{ObservedAt: t1.Add(-time.Minute), Blob: empty},
+			want: []consumed{
+				{t1, "", `[{"id":"a"}]`},
+				{t1.Add(4 * time.Minute), "", `[]`},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			feed := &testFeed{etags: tc.etags}
+			srv := httptest.NewServer(feed)
+			defer srv.Close()
+
+			var now time.Time
+			p := httpPoller{client: srv.Client(), url: srv.URL, lastBlob: tc.resume.Blob, lastAt: tc.resume.ObservedAt, now: func() time.Time { return now }}
+
+			var got []consumed
+			for _, s := range steps {
+				now = s.at
+				feed.set(s.status, s.body)
+				err := p.poll(context.Background(), func(_ context.Context, s snapshot, r io.Reader) error {
+					b, err := io.ReadAll(r)
+					if err != nil {
+						return err
+					}
+					if s.Source != "http" {
+						t.Errorf("got source %q, want http", s.Source)
+					}
+					got = append(got, consumed{ObservedAt: s.ObservedAt, Outages: string(b)})
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("consumed mismatch (-want +got):\n%s", d)
+			}
+			if feed.notModifieds != tc.wantNotModifieds {
+				t.Errorf("got %d not modified responses, want %d", feed.notModifieds, tc.wantNotModifieds)
+			}
+		})
+	}
+}
+
+func TestHTTPSourceStops(t *testing.T) {
+	feed := &testFeed{etags: true}
+	feed.set(http.StatusOK, `[]`)
+	srv := httptest.NewServer(feed)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var consumes int
+	first := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- httpSource(ctx, srv.Client(), srv.URL, time.Millisecond, ingestState{}, func(context.Context, snapshot, io.Reader) error {
+			consumes++
+			if consumes == 1 {
+				close(first)
+			}
+			return nil
+		})
+	}()
+
+	<-first
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if consumes != 1 {
+		t.Errorf("got %d consumes, want 1", consumes)
+	}
+
+	wantErr := errors.New("consume failed")
+	err := httpSource(context.Background(), srv.Client(), srv.URL, time.Millisecond, ingestState{}, func(context.Context, snapshot, io.Reader) error {
+		return wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	_ "embed"
@@ -11,8 +13,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -22,6 +31,7 @@ import (
 	_ "github.com/ncruces/go-sqlite3/driver"
 	_ "github.com/ncruces/go-sqlite3/embed"
 	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
 	"github.com/paulmach/orb/geojson"
 	"github.com/paulmach/orb/planar"
 	"github.com/peterbourgon/ff"
@@ -29,17 +39,59 @@ import (
 )
 
 func main() {
-	var databaseFile, repoRemote, repoPath, placesFile string
+	var databaseFile, repoRemote, repoPath, repoCacheDir, outagesPath, snapshotsPath, snapshotTimeLayout, pollURL, placesFile, placeLevelsFile, matchStrategy string
+	var pollInterval, watchInterval time.Duration
+	var workers int
+	var revs gitRange
+	var matchDistance float64
+	var grace missingGrace
+	var recurrenceWindow time.Duration
+	var skipUnchanged, archiveSnapshots bool
 	fs := flag.NewFlagSet("outages-to-sqlite", flag.ExitOnError)
 	fs.StringVar(&databaseFile, "database-file", "outages.db", "data file path")
 	fs.StringVar(&repoRemote, "repo-remote", "https://github.com/danp/nspoweroutages.git", "git remote of nspoweroutages repo")
 	fs.StringVar(&repoPath, "repo-path", "", "path to nspoweroutages git repo clone, preferred over -repo-remote if set")
+	fs.StringVar(&repoCacheDir, "repo-cache-dir", "", "directory to keep a clone of -repo-remote in, fetching new commits on later runs instead of cloning in memory")
+	fs.StringVar(&outagesPath, "outages-path", "data/outages.json", "path of the outages file in the repo")
+	fs.StringVar(&revs.From, "from", "", "when not resuming, only read commits after this revision, eg a tag or commit hash")
+	fs.StringVar(&revs.To, "to", "", "read commits up to and including this revision, eg origin/test or a commit hash, defaults to HEAD")
+	fs.StringVar(&snapshotsPath, "snapshots-path", "", "directory, tar or zip archive of outages .json files to read instead of the repo")
+	fs.StringVar(&snapshotTimeLayout, "snapshot-time-layout", "", "Go time layout to parse -snapshots-path file names with to get their observation times, eg outages-20060102T150405Z.json, defaults to using modification times")
+	fs.StringVar(&pollURL, "poll-url", "", "URL of the live outages file to poll instead of reading the repo, runs until interrupted")
+	fs.DurationVar(&pollInterval, "poll-interval", time.Minute, "how often to fetch -poll-url")
+	fs.DurationVar(&watchInterval, "watch-interval", 5*time.Minute, "how often watch ingests new snapshots")
+	fs.IntVar(&workers, "workers", runtime.GOMAXPROCS(0), "number of snapshots to decode and place in parallel")
 	fs.StringVar(&placesFile, "places-file", "", "featurecollection geojson file to use for turning outage geometries into places, defaults to embedded data")
+	fs.StringVar(&placeLevelsFile, "place-levels", "", "JSON file listing the place levels to place outages at, defaults to county and neighborhood")
+	fs.StringVar(&matchStrategy, "match", "lonlat", "how observed outages are matched to known ones: lonlat, id, distance or area")
+	fs.Float64Var(&matchDistance, "match-distance", 100, "maximum distance in metres between outages for -match distance")
+	fs.IntVar(&grace.snapshots, "missing-grace-snapshots", 0, "number of snapshots an outage may be absent from before it is considered missing")
+	fs.DurationVar(&grace.duration, "missing-grace", 0, "how long an outage may be absent for before it is considered missing")
+	fs.DurationVar(&recurrenceWindow, "recurrence-window", 24*time.Hour, "link new outages to ones resolved at the same location within this long, 0 to disable")
+	fs.BoolVar(&skipUnchanged, "skip-unchanged", false, "extend the previous event for unchanged observations instead of adding new ones")
+	fs.BoolVar(&archiveSnapshots, "archive-snapshots", false, "store each raw outages file in the snapshots table so history can be rederived without the repo")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] [rederive|watch|replace-places]\n\nWith no command, ingests new snapshots from the repo. rederive rebuilds\noutages, events and summaries from archived snapshots. watch ingests\nnew snapshots every -watch-interval until interrupted. replace-places\nplaces every stored outage again with the current places and levels.\n\n", fs.Name())
+		fs.PrintDefaults()
+	}
 	ff.Parse(fs, os.Args[1:])
 
-	var openRepo func() (*git.Repository, error)
+	cmd := fs.Arg(0)
+	if cmd != "" && cmd != "rederive" && cmd != "watch" && cmd != "replace-places" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	matcher, err := newOutageMatcher(matchStrategy, matchDistance)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var openRepo func(context.Context) (*git.Repository, error)
 	if repoPath != "" {
 		openRepo = localOpenRepo(repoPath)
+	} else if repoRemote != "" && repoCacheDir != "" {
+		openRepo = cachedOpenRepo(repoRemote, repoCacheDir)
 	} else if repoRemote != "" {
 		openRepo = remoteOpenRepo(repoRemote)
 	} else {
@@ -61,100 +113,398 @@ func main() {
 		log.Fatal(err)
 	}
 
-	pl := newPlacer(places)
+	levels, err := loadPlaceLevels(placeLevelsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pl, err := newPlacer(places, levels)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Interrupting stops between snapshots, after committing the ones
+	// already consumed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	tracker := newOutageTracker(st)
-	if err := tracker.loadState(); err != nil {
+	if err := st.savePlaces(ctx, pl.records); err != nil {
 		log.Fatal(err)
 	}
 
-	var maxObservedAt time.Time
-	if err := db.QueryRow("select max(last_observed) from outage_summaries").Scan(newTimeScanner(&maxObservedAt)); err != nil {
+	if cmd == "replace-places" {
+		changed, total, err := st.replacePlaces(ctx, pl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("replaced places,", changed, "of", total, "outages changed place")
+		return
+	}
+
+	var archived []snapshot
+	if cmd == "rederive" {
+		// Check everything can be replayed before deleting anything.
+		if archived, err = st.archivedObservations(ctx); err != nil {
+			log.Fatal(err)
+		}
+		if err := st.resetDerived(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	tracker := newOutageTracker(st, matcher)
+	tracker.grace = grace
+	tracker.recurrenceWindow = recurrenceWindow
+	tracker.skipUnchanged = skipUnchanged
+	tracker.placeOverlaps = pl.placeOverlaps
+	if err := tracker.loadState(ctx); err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println("tracker starting with", len(tracker.known), "known outages and sourcing after", maxObservedAt)
+	source := "git"
+	if snapshotsPath != "" {
+		source = "dir"
+	} else if pollURL != "" {
+		source = "http"
+	}
 
-	consume := func(t time.Time, r io.Reader) error {
-		var outages []outage
-		if err := json.NewDecoder(r).Decode(&outages); err != nil {
-			return fmt.Errorf("decoding outages: %w", err)
+	pipe := pipeline{
+		workers: workers,
+		prepare: func(s snapshot, data []byte) ([]outage, error) {
+			var outages []outage
+			if err := json.Unmarshal(data, &outages); err != nil {
+				return nil, fmt.Errorf("decoding outages: %w", err)
+			}
+
+			if err := pl.place(outages); err != nil {
+				return nil, fmt.Errorf("placing outages: %w", err)
+			}
+
+			return outages, nil
+		},
+		record: func(ctx context.Context, s snapshot, data []byte, outages []outage) error {
+			if archiveSnapshots && s.ObservationID == 0 {
+				if err := st.archiveSnapshot(ctx, s.Blob, data); err != nil {
+					return err
+				}
+			}
+
+			return tracker.observe(ctx, s, outages)
+		},
+	}
+
+	if cmd == "rederive" {
+		log.Println("rederiving from", len(archived), "archived observations")
+		err := pipe.run(ctx, func(ctx context.Context, consume func(context.Context, snapshot, io.Reader) error) error {
+			return archiveSource(ctx, st, archived, consume)
+		})
+		if errors.Is(err, context.Canceled) {
+			log.Fatal("rederive interrupted, run it again to finish")
 		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-		if err := pl.place(outages); err != nil {
-			return fmt.Errorf("placing outages: %w", err)
+	ingest := func(ctx context.Context) error {
+		resume, err := st.ingestState(ctx, source)
+		if err != nil {
+			return err
+		}
+		if resume == (ingestState{}) {
+			// Databases from before ingest_state, or that were
+			// ingested from another source, only have times.
+			if resume.ObservedAt, err = st.lastObservedAt(ctx); err != nil {
+				return err
+			}
 		}
 
-		return tracker.observe(t, outages)
+		log.Println("tracker starting with", len(tracker.known), "known outages and sourcing from", source, "after commit", resume.Commit, "at", resume.ObservedAt)
+
+		return pipe.run(ctx, func(ctx context.Context, consume func(context.Context, snapshot, io.Reader) error) error {
+			switch source {
+			case "dir":
+				return dirSource(ctx, snapshotsPath, snapshotTimeLayout, resume, consume)
+			case "http":
+				return httpSource(ctx, http.DefaultClient, pollURL, pollInterval, resume, consume)
+			}
+			return gitSource(ctx, openRepo, outagesPath, revs, resume, consume)
+		})
 	}
 
-	if err := gitSource(openRepo, "data/outages.json", maxObservedAt, consume); err != nil {
+	if cmd == "watch" {
+		err = watch(ctx, watchInterval, ingest)
+	} else {
+		err = ingest(ctx)
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Println("stopped")
+		err = nil
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func localOpenRepo(path string) func() (*git.Repository, error) {
-	return func() (*git.Repository, error) {
+// watch calls ingest every interval until ctx is done. Ingest errors
+// are logged and retried at the next interval.
+func watch(ctx context.Context, interval time.Duration, ingest func(context.Context) error) error {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		if err := ingest(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Println("watch ingest failed, trying again next interval:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+func localOpenRepo(path string) func(context.Context) (*git.Repository, error) {
+	return func(context.Context) (*git.Repository, error) {
 		log.Println("gitSource using local path", path)
 		return git.PlainOpen(path)
 	}
 }
 
-func remoteOpenRepo(remote string) func() (*git.Repository, error) {
-	return func() (*git.Repository, error) {
-		log.Println("gitSource cloning from", remote)
-		return git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
-			URL: remote,
-		})
+// remoteOpenRepo clones remote in memory the first time it's called
+// and fetches new commits into the same clone after that.
+func remoteOpenRepo(remote string) func(context.Context) (*git.Repository, error) {
+	var repo *git.Repository
+	return func(ctx context.Context) (*git.Repository, error) {
+		if repo == nil {
+			log.Println("gitSource cloning from", remote)
+			r, err := git.CloneContext(ctx, memory.NewStorage(), nil, &git.CloneOptions{
+				URL: remote,
+			})
+			if err != nil {
+				return nil, err
+			}
+			repo = r
+			return repo, nil
+		}
+
+		log.Println("gitSource fetching from", remote)
+		if err := repo.FetchContext(ctx, &git.FetchOptions{}); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil, fmt.Errorf("fetching %s: %w", remote, err)
+		}
+		return repo, fastForwardHead(repo)
 	}
 }
 
-func gitSource(openRepo func() (*git.Repository, error), outagesFileName string, since time.Time, consume func(time.Time, io.Reader) error) error {
-	repo, err := openRepo()
+// fastForwardHead points the branch HEAD is on at its fetched
+// remote-tracking branch, as cloning only sets it once.
+func fastForwardHead(repo *git.Repository) error {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
 	if err != nil {
-		return fmt.Errorf("opening repo: %w", err)
+		return fmt.Errorf("head: %w", err)
+	}
+	if head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+		return nil
+	}
+	remote, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, head.Target().Short()), true)
+	if err != nil {
+		return fmt.Errorf("remote branch of %s: %w", head.Target(), err)
 	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(head.Target(), remote.Hash()))
+}
 
+// cachedOpenRepo keeps a mirror of remote in dir, cloning it on first
+// use and fetching new commits after that. A mirror that can't be read
+// is removed and cloned again.
+func cachedOpenRepo(remote, dir string) func(context.Context) (*git.Repository, error) {
+	return func(ctx context.Context) (*git.Repository, error) {
+		repo, err := openCachedRepo(remote, dir)
+		if errors.Is(err, git.ErrRepositoryNotExists) {
+			if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+				return nil, fmt.Errorf("repo cache %s is not empty and is not a repo", dir)
+			}
+			return cloneCachedRepo(ctx, remote, dir)
+		}
+		var corrupt corruptCacheError
+		if errors.As(err, &corrupt) {
+			log.Println("gitSource removing unusable repo cache", dir, "and cloning again:", err)
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+			return cloneCachedRepo(ctx, remote, dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		log.Println("gitSource fetching from", remote, "into", dir)
+		err = repo.FetchContext(ctx, &git.FetchOptions{})
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return repo, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fetching %s: %w", remote, err)
+		}
+		return repo, checkCachedRepo(repo)
+	}
+}
+
+// wrongRemoteError is returned by openCachedRepo when the cache is of
+// a different remote. It's left alone rather than being removed in
+// case it isn't really a cache.
+type wrongRemoteError struct {
+	dir, got, want string
+}
+
+func (e wrongRemoteError) Error() string {
+	if e.got == "" {
+		return fmt.Sprintf("repo cache %s has no %s remote, want %s", e.dir, git.DefaultRemoteName, e.want)
+	}
+	return fmt.Sprintf("repo cache %s is of %s, not %s", e.dir, e.got, e.want)
+}
+
+// corruptCacheError is returned by openCachedRepo when the cache is of
+// the right remote but can't be read, so it can be cloned again.
+type corruptCacheError struct {
+	dir string
+	err error
+}
+
+func (e corruptCacheError) Error() string {
+	return fmt.Sprintf("repo cache %s is corrupt: %v", e.dir, e.err)
+}
+
+func (e corruptCacheError) Unwrap() error {
+	return e.err
+}
+
+func openCachedRepo(remote, dir string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := repo.Remote(git.DefaultRemoteName)
+	if errors.Is(err, git.ErrRemoteNotFound) {
+		return nil, wrongRemoteError{dir: dir, want: remote}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if urls := origin.Config().URLs; len(urls) == 0 || urls[0] != remote {
+		return nil, wrongRemoteError{dir: dir, got: strings.Join(urls, ", "), want: remote}
+	}
+	if err := checkCachedRepo(repo); err != nil {
+		return nil, corruptCacheError{dir: dir, err: err}
+	}
+	return repo, nil
+}
+
+func cloneCachedRepo(ctx context.Context, remote, dir string) (*git.Repository, error) {
+	log.Println("gitSource cloning from", remote, "into", dir)
+	repo, err := git.PlainCloneContext(ctx, dir, true, &git.CloneOptions{
+		URL:    remote,
+		Mirror: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repo, checkCachedRepo(repo)
+}
+
+// checkCachedRepo reports whether repo's head commit can be read.
+func checkCachedRepo(repo *git.Repository) error {
 	head, err := repo.Head()
 	if err != nil {
 		return fmt.Errorf("head: %w", err)
 	}
-
-	logOpts := &git.LogOptions{
-		Order: git.LogOrderCommitterTime,
-		From:  head.Hash(),
+	if _, err := repo.CommitObject(head.Hash()); err != nil {
+		return fmt.Errorf("head commit: %w", err)
 	}
-	if !since.IsZero() {
-		logSince := since.Add(-time.Second) // we want to see it
-		logOpts.Since = &logSince
+	return nil
+}
+
+// gitRange bounds the commits gitSource reads.
+type gitRange struct {
+	// From is the revision to read commits after when not resuming.
+	// Empty means from the first commit.
+	From string
+	// To is the last revision to read, HEAD if empty.
+	To string
+}
+
+// gitSource calls consume with each version of outagesFileName committed
+// after resume up to revs.To, oldest first. It resumes after
+// resume.Commit if that is in the history, otherwise after the commit
+// with committer time resume.ObservedAt. With nothing to resume from,
+// it starts after revs.From.
+func gitSource(ctx context.Context, openRepo func(context.Context) (*git.Repository, error), outagesFileName string, revs gitRange, resume ingestState, consume func(context.Context, snapshot, io.Reader) error) error {
+	repo, err := openRepo(ctx)
+	if err != nil {
+		return fmt.Errorf("opening repo: %w", err)
 	}
 
-	iter, err := repo.Log(logOpts)
+	to := revs.To
+	if to == "" {
+		to = "HEAD"
+	}
+	head, err := repo.ResolveRevision(plumbing.Revision(to))
 	if err != nil {
-		return fmt.Errorf("log: %w", err)
+		return fmt.Errorf("resolving to revision %q: %w", to, err)
 	}
 
-	var sawSince bool
 	var commits []*object.Commit
-	for {
-		c, err := iter.Next()
-		if errors.Is(err, io.EOF) {
-			break
+	var lastHash plumbing.Hash
+	since := resume.ObservedAt
+
+	resuming := resume.Commit != "" || !since.IsZero()
+	if revs.From != "" && resuming {
+		log.Println("gitSource resuming, ignoring from revision", revs.From)
+	}
+
+	var found bool
+	if revs.From != "" && !resuming {
+		from, err := repo.ResolveRevision(plumbing.Revision(revs.From))
+		if err != nil {
+			return fmt.Errorf("resolving from revision %q: %w", revs.From, err)
 		}
+		commits, found, err = commitsAfterHash(repo, *head, *from)
 		if err != nil {
-			return fmt.Errorf("iterating commits: %w", err)
+			return err
 		}
-		if !since.IsZero() && c.Committer.When.Equal(since) {
-			sawSince = true
-			break
+		if !found {
+			return fmt.Errorf("from revision %q (%v) is not in the history of %v", revs.From, from, head)
+		}
+		fc, err := repo.CommitObject(*from)
+		if err != nil {
+			return fmt.Errorf("from commit: %w", err)
+		}
+		if f, err := fc.File(outagesFileName); err == nil {
+			lastHash = f.Hash
+		} else if err != object.ErrFileNotFound {
+			return fmt.Errorf("from file: %w", err)
+		}
+	} else if resume.Commit != "" {
+		commits, found, err = commitsAfterHash(repo, *head, plumbing.NewHash(resume.Commit))
+		if err != nil {
+			return err
+		}
+		if found {
+			// Times don't matter when resuming from a commit.
+			since = time.Time{}
+			lastHash = plumbing.NewHash(resume.Blob)
+		} else {
+			log.Println("gitSource did not find resume commit", resume.Commit, "in history of", head, "(was it rewritten?), falling back to committer time", since)
 		}
-		commits = append(commits, c)
 	}
-	if !sawSince {
-		return fmt.Errorf("did not see since commit %v", since)
+	if !found {
+		commits, err = commitsAfterTime(repo, *head, since)
+		if err != nil {
+			return err
+		}
 	}
 
-	var lastHash plumbing.Hash
 	process := func(c *object.Commit) error {
 		tr, err := c.Tree()
 		if err != nil {
@@ -190,10 +540,22 @@ func gitSource(openRepo func() (*git.Repository, error), outagesFileName string,
 		}
 		defer r.Close()
 
-		return consume(c.Committer.When, r)
+		return consume(ctx, snapshot{
+			ObservedAt: c.Committer.When,
+			Source:     "git",
+			Commit:     c.Hash.String(),
+			Blob:       f.Hash.String(),
+			Author:     c.Author.String(),
+			Message:    c.Message,
+		}, r)
 	}
 
 	for i := len(commits) - 1; i >= 0; i-- {
+		// Stop between snapshots when ctx is done, everything
+		// consumed so far is recorded.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		c := commits[i]
 		if err := process(c); err != nil {
 			return fmt.Errorf("process: %w", err)
@@ -203,40 +565,180 @@ func gitSource(openRepo func() (*git.Repository, error), outagesFileName string,
 	return nil
 }
 
+// commitsAfterHash returns the commits from head back to, but not
+// including, since, newest first. It reports false if since wasn't
+// found.
+func commitsAfterHash(repo *git.Repository, head, since plumbing.Hash) ([]*object.Commit, bool, error) {
+	iter, err := repo.Log(&git.LogOptions{Order: git.LogOrderCommitterTime, From: head})
+	if err != nil {
+		return nil, false, fmt.Errorf("log: %w", err)
+	}
+	defer iter.Close()
+
+	var commits []*object.Commit
+	for {
+		c, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("iterating commits: %w", err)
+		}
+		if c.Hash == since {
+			return commits, true, nil
+		}
+		commits = append(commits, c)
+	}
+}
+
+// commitsAfterTime returns the commits from head back to, but not
+// including, the first with committer time since, newest first. A zero
+// since returns all commits.
+func commitsAfterTime(repo *git.Repository, head plumbing.Hash, since time.Time) ([]*object.Commit, error) {
+	logOpts := &git.LogOptions{
+		Order: git.LogOrderCommitterTime,
+		From:  head,
+	}
+	if !since.IsZero() {
+		logSince := since.Add(-time.Second) // we want to see it
+		logOpts.Since = &logSince
+	}
+
+	iter, err := repo.Log(logOpts)
+	if err != nil {
+		return nil, fmt.Errorf("log: %w", err)
+	}
+	defer iter.Close()
+
+	var sawSince bool
+	var commits []*object.Commit
+	for {
+		c, err := iter.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iterating commits: %w", err)
+		}
+		if !since.IsZero() && c.Committer.When.Equal(since) {
+			sawSince = true
+			break
+		}
+		commits = append(commits, c)
+	}
+	if !since.IsZero() && !sawSince {
+		return nil, fmt.Errorf("did not see since commit with committer time %v in history of %v", since, head)
+	}
+
+	return commits, nil
+}
+
+// snapshot describes where an observed outages file came from.
+type snapshot struct {
+	ObservedAt time.Time
+	// Source names what produced the snapshot, eg "git". Progress
+	// is recorded in ingest_state for snapshots with a Source.
+	Source string
+	// Git commit and outages file blob hashes, if any.
+	Commit, Blob string
+	// Git commit author and message, if any.
+	Author, Message string
+	// ObservationID is the existing observations row for the
+	// snapshot when it is being replayed, otherwise 0.
+	ObservationID int
+}
+
+// ingestState is where a source left off.
+type ingestState struct {
+	Commit, Blob string
+	ObservedAt   time.Time
+}
+
 type store struct {
 	db *sql.DB
 }
 
 func (s *store) init() error {
-	if _, err := s.db.Exec("create table if not exists outages (id integer primary key, longitude numeric, latitude numeric, county text, neighborhood text, area_polyline text)"); err != nil {
-		return err
+	return migrate(s.db)
+}
+
+// ingestState returns where source left off, or the zero ingestState
+// if it hasn't been recorded.
+func (s *store) ingestState(ctx context.Context, source string) (ingestState, error) {
+	var is ingestState
+	var commit, blob sql.NullString
+	err := s.db.QueryRowContext(ctx, "select commit_hash, blob_hash, observed_at from ingest_state where source=?", source).Scan(&commit, &blob, newTimeScanner(&is.ObservedAt))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ingestState{}, nil
 	}
+	if err != nil {
+		return ingestState{}, err
+	}
+	is.Commit, is.Blob = commit.String, blob.String
+	return is, nil
+}
 
-	if _, err := s.db.Exec("create table if not exists outage_events (outage_id integer references outages on delete cascade, observed_at datetime, removed bool, cause text, cust_aff int, start datetime, etr datetime, primary key(outage_id, observed_at))"); err != nil {
-		return err
+func (s *store) lastObservedAt(ctx context.Context) (time.Time, error) {
+	var t time.Time
+	if err := s.db.QueryRowContext(ctx, "select max(last_observed) from outage_summaries").Scan(newTimeScanner(&t)); err != nil {
+		return time.Time{}, err
 	}
+	return t, nil
+}
 
-	if _, err := s.db.Exec("create table if not exists outage_summaries (id integer primary key references outages on delete cascade, resolved bool, first_observed datetime, last_observed datetime, observations int, min_cust_aff int, max_cust_aff int, min_start datetime, max_etr datetime, last_cause text, longitude numeric, latitude numeric, county text, neighborhood text)"); err != nil {
-		return err
+// observationsAfter returns the observations observed after since,
+// oldest first, with only their ObservedAt and ObservationID set.
+func (s *store) observationsAfter(ctx context.Context, since time.Time) ([]snapshot, error) {
+	rows, err := s.db.QueryContext(ctx, "select id, observed_at from observations where observed_at > ? order by observed_at, id", since.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	if _, err := s.db.Exec("create index if not exists outage_summaries_unresolved on outage_summaries (id, last_observed) where resolved=0"); err != nil {
-		return err
+	var snaps []snapshot
+	for rows.Next() {
+		var snap snapshot
+		if err := rows.Scan(&snap.ObservationID, newTimeScanner(&snap.ObservedAt)); err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
+	return snaps, rows.Close()
+}
 
-	return nil
+func (s *store) currentOutages(ctx context.Context) (map[int]trackedOutage, error) {
+	return s.outagesAsOfLastObserved(ctx, "resolved=0")
+}
+
+// recentlyResolved returns outages resolved at or after since.
+func (s *store) recentlyResolved(ctx context.Context, since time.Time) (map[int]trackedOutage, error) {
+	return s.outagesAsOfLastObserved(ctx, "resolved=1 and last_observed >= ?", since.Format(time.RFC3339))
 }
 
-func (s *store) currentOutages() (map[int]trackedOutage, error) {
-	rows, err := s.db.Query(`
-with max_observed_ats as (select id as outage_id, last_observed as max_observed_at from outage_summaries where resolved=0)
-select id, longitude, latitude, county, neighborhood, observed_at, cause, cust_aff, start, etr
-from outages, outage_events, max_observed_ats
-where max_observed_ats.outage_id=outage_events.outage_id and
-max_observed_ats.max_observed_at=outage_events.observed_at and
-outages.id=outage_events.outage_id
-order by observed_at
-`)
+// outagesAsOfLastObserved returns the outages with summaries matching
+// cond, each with its last event and that event's cluster members. The
+// event's ObservedAt is when it was last seen, which is later than
+// when it was recorded if it was extended by unchanged observations.
+func (s *store) outagesAsOfLastObserved(ctx context.Context, cond string, args ...any) (map[int]trackedOutage, error) {
+	lastEvents := `
+with last_events as (
+  select id as outage_id, (select max(observed_at) from outage_events where outage_id=outage_summaries.id) as observed_at
+  from outage_summaries
+  where ` + cond + `
+)
+`
+	rows, err := s.db.QueryContext(ctx, lastEvents+`
+select o.id, o.longitude, o.latitude, o.county, o.neighborhood,
+(select a.area from outage_events a where a.outage_id=o.id and a.area is not null order by a.observed_at desc limit 1),
+o.upstream_id, coalesce(e.seen_until, e.observed_at), e.cause, e.cust_aff, e.cust_aff_masked, e.start, e.etr, e.cluster, e.n_out
+from last_events l
+join outages o on o.id=l.outage_id
+join outage_events e on e.outage_id=l.outage_id and e.observed_at=l.observed_at
+order by 8
+`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -248,60 +750,412 @@ order by observed_at
 		var ev trackingEvent
 		var ou outage
 		var lon, lat float64
-		var cause, county, neighborhood sql.NullString
-		if err := rows.Scan(&to.ID, &lon, &lat, &county, &neighborhood, &ev.ObservedAt, &cause, &ou.Desc.CustA.Val, &ou.Desc.Start, &ou.Desc.ETR); err != nil {
+		var cause, county, neighborhood, area, upstreamID sql.NullString
+		var masked, cluster sql.NullBool
+		var nOut sql.NullInt64
+		if err := rows.Scan(&to.ID, &lon, &lat, &county, &neighborhood, &area, &upstreamID, newTimeScanner(&ev.ObservedAt), &cause, &ou.Desc.CustA.Val, &masked, &ou.Desc.Start, &ou.Desc.ETR, &cluster, &nOut); err != nil {
+			return nil, err
+		}
+
+		ou.ID = upstreamID.String
+		ou.Desc.Cause = cause.String
+		ou.Desc.CustA.Masked = masked.Bool
+		ou.Desc.Cluster = cluster.Bool
+		ou.Desc.NOut = int(nOut.Int64)
+
+		ou.Geom.Lon = lon
+		ou.Geom.Lat = lat
+		ou.Geom.County = county.String
+		ou.Geom.Neighborhood = neighborhood.String
+		if area.Valid {
+			g, err := geojson.UnmarshalGeometry([]byte(area.String))
+			if err != nil {
+				return nil, fmt.Errorf("outage %d area: %w", to.ID, err)
+			}
+			ou.Geom.Area, _ = g.Geometry().(orb.MultiPolygon)
+		}
+
+		to.Outage = ou
+		to.Events = []trackingEvent{ev}
+		out[to.ID] = to
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	// Without its members, the next observation of a cluster would
+	// look changed.
+	rows, err = s.db.QueryContext(ctx, lastEvents+`
+select m.outage_id, m.cause, m.cust_aff, m.cust_aff_masked, m.start, m.etr
+from last_events l
+join outage_cluster_members m on m.outage_id=l.outage_id and m.observed_at=l.observed_at
+order by m.outage_id, m.member
+`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var m outageDesc
+		var cause sql.NullString
+		var masked sql.NullBool
+		if err := rows.Scan(&id, &cause, &m.CustA.Val, &masked, &m.Start, &m.ETR); err != nil {
 			return nil, err
 		}
+		m.Cause = cause.String
+		m.CustA.Masked = masked.Bool
+
+		to := out[id]
+		to.Outage.Desc.Outages = append(to.Outage.Desc.Outages, m)
+		out[id] = to
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return out, rows.Close()
+}
+
+type storeObs struct {
+	tx *sql.Tx
+	id int
+}
+
+func (s storeObs) observationID() int {
+	return s.id
+}
+
+func (s storeObs) emit(ctx context.Context, to trackedOutage) (int, error) {
+	if le := to.Events[len(to.Events)-1]; le.ObservationID == 0 {
+		le.ObservationID = s.id
+		to.Events = append(slices.Clip(to.Events[:len(to.Events)-1]), le)
+	}
+	return storeEmitExec(ctx, s.tx, to)
+}
+
+func (s storeObs) extend(ctx context.Context, to trackedOutage) error {
+	return storeExtendExec(ctx, s.tx, to)
+}
+
+func (s storeObs) link(ctx context.Context, id, linkedID int, kind string) error {
+	_, err := s.tx.ExecContext(ctx, "insert into outage_links (outage_id, linked_outage_id, kind) values (?, ?, ?)", id, linkedID, kind)
+	return err
+}
+
+func (s storeObs) commit() error {
+	return s.tx.Commit()
+}
+
+func (s storeObs) rollback() error {
+	// Already rolled back if its context is done.
+	if err := s.tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		return err
+	}
+	return nil
+}
+
+func (s *store) beginObservation(ctx context.Context, snap snapshot, outages int) (storeObservation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	id := snap.ObservationID
+	if id != 0 {
+		_, err = tx.ExecContext(ctx, "update observations set outage_count=? where id=?", outages, id)
+	} else {
+		var res sql.Result
+		res, err = tx.ExecContext(ctx,
+			"insert into observations (observed_at, source, commit_hash, blob_hash, author, message, outage_count) values (?, ?, ?, ?, ?, ?, ?)",
+			snap.ObservedAt.Format(time.RFC3339), nullString(snap.Source), nullString(snap.Commit), nullString(snap.Blob), nullString(snap.Author), nullString(snap.Message), outages,
+		)
+		if err == nil {
+			var lid int64
+			lid, err = res.LastInsertId()
+			id = int(lid)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if snap.Source != "" {
+		_, err := tx.ExecContext(ctx,
+			"insert into ingest_state (source, commit_hash, blob_hash, observed_at) values (?, ?, ?, ?) on conflict(source) do update set commit_hash=excluded.commit_hash, blob_hash=excluded.blob_hash, observed_at=excluded.observed_at",
+			snap.Source, snap.Commit, snap.Blob, snap.ObservedAt.Format(time.RFC3339),
+		)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return storeObs{tx: tx, id: id}, nil
+}
+
+// archiveSnapshot stores the raw outages file data with blob hash
+// blob, gzipped, unless it is already stored.
+func (s *store) archiveSnapshot(ctx context.Context, blob string, data []byte) error {
+	if blob == "" {
+		return errors.New("archiving snapshot: no blob hash")
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, "insert into snapshots (blob_hash, encoding, data) values (?, 'gzip', ?) on conflict(blob_hash) do nothing", blob, buf.Bytes())
+	return err
+}
+
+// archivedSnapshot returns a reader for the raw outages file data
+// archived with blob hash blob.
+func (s *store) archivedSnapshot(ctx context.Context, blob string) (io.Reader, error) {
+	var encoding string
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, "select encoding, data from snapshots where blob_hash=?", blob).Scan(&encoding, &data); err != nil {
+		return nil, fmt.Errorf("archived snapshot %s: %w", blob, err)
+	}
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(bytes.NewReader(data))
+	}
+	return nil, fmt.Errorf("archived snapshot %s: unknown encoding %q", blob, encoding)
+}
+
+// archivedObservations returns every observation, oldest first, for
+// replaying with archiveSource. It fails if any derived data can't be
+// rebuilt from archived snapshots.
+func (s *store) archivedObservations(ctx context.Context) ([]snapshot, error) {
+	var untracked int
+	if err := s.db.QueryRowContext(ctx, "select count(*) from outage_events where observation_id is null").Scan(&untracked); err != nil {
+		return nil, err
+	}
+	if untracked > 0 {
+		return nil, fmt.Errorf("%d events were recorded before observations were, so can't be rederived", untracked)
+	}
+
+	var missing int
+	if err := s.db.QueryRowContext(ctx, "select count(*) from observations o where not exists (select 1 from snapshots s where s.blob_hash=o.blob_hash)").Scan(&missing); err != nil {
+		return nil, err
+	}
+	if missing > 0 {
+		return nil, fmt.Errorf("%d observations have no archived snapshot", missing)
+	}
+
+	rows, err := s.db.QueryContext(ctx, "select id, observed_at, source, commit_hash, blob_hash, author, message from observations order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snaps []snapshot
+	for rows.Next() {
+		var snap snapshot
+		var source, commit, author, message sql.NullString
+		if err := rows.Scan(&snap.ObservationID, newTimeScanner(&snap.ObservedAt), &source, &commit, &snap.Blob, &author, &message); err != nil {
+			return nil, err
+		}
+		snap.Source, snap.Commit, snap.Author, snap.Message = source.String, commit.String, author.String, message.String
+		snaps = append(snaps, snap)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return snaps, rows.Close()
+}
+
+// savePlaces upserts places into the places table. Places no longer
+// loaded are kept for the outages already placed in them.
+func (s *store) savePlaces(ctx context.Context, places []placeRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range places {
+		var geometry, parentID any
+		if p.Geometry != nil {
+			b, err := geojson.NewGeometry(p.Geometry).MarshalJSON()
+			if err != nil {
+				return err
+			}
+			geometry = string(b)
+		}
+		if p.ParentID != 0 {
+			parentID = p.ParentID
+		}
+		if _, err := tx.ExecContext(ctx, `
+insert into places (id, placetype, name, parent_id, geometry) values (?, ?, ?, ?, ?)
+on conflict (id) do update set placetype=excluded.placetype, name=excluded.name, parent_id=excluded.parent_id, geometry=excluded.geometry`,
+			p.ID, nullString(p.PlaceType), nullString(p.Name), parentID, geometry); err != nil {
+			return fmt.Errorf("saving place %d: %w", p.ID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// replacePlaces places every stored outage again with pl in a single
+// transaction, as if it were ingested now, updating outage_places,
+// outage_place_overlaps and the county and neighborhood columns. It
+// returns how many of the total
+// outages changed place, not counting ones that only gained place IDs.
+func (s *store) replacePlaces(ctx context.Context, pl *placer) (changed, total int, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	old := make(map[int][]outagePlace)
+	rows, err := tx.QueryContext(ctx, "select outage_id, level, name, coalesce(place_id, 0) from outage_places order by outage_id, rowid")
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var id int
+		var p outagePlace
+		if err := rows.Scan(&id, &p.Level, &p.Name, &p.PlaceID); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		old[id] = append(old[id], p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	rows, err = tx.QueryContext(ctx, "select id, longitude, latitude, points, area from outages order by id")
+	if err != nil {
+		return 0, 0, err
+	}
+	placed := make(map[int]outageGeom)
+	for rows.Next() {
+		var id int
+		var g outageGeom
+		var lon, lat sql.NullFloat64
+		var points, area sql.NullString
+		if err := rows.Scan(&id, &lon, &lat, &points, &area); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		g.Lon, g.Lat = lon.Float64, lat.Float64
+		if points.Valid {
+			pg, err := geojson.UnmarshalGeometry([]byte(points.String))
+			if err != nil {
+				rows.Close()
+				return 0, 0, fmt.Errorf("outage %d points: %w", id, err)
+			}
+			g.Points, _ = pg.Geometry().(orb.MultiPoint)
+		}
+		if area.Valid {
+			ag, err := geojson.UnmarshalGeometry([]byte(area.String))
+			if err != nil {
+				rows.Close()
+				return 0, 0, fmt.Errorf("outage %d area: %w", id, err)
+			}
+			g.Area, _ = ag.Geometry().(orb.MultiPolygon)
+		}
+		pl.placeGeom(&g)
+		placed[id] = g
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
 
-		ou.Desc.Cause = cause.String
-
-		ou.Geom.Lon = lon
-		ou.Geom.Lat = lat
-		ou.Geom.County = county.String
-		ou.Geom.Neighborhood = neighborhood.String
-
-		to.Outage = ou
-		to.Events = []trackingEvent{ev}
-		out[to.ID] = to
+	// Overlaps weren't recorded for outages stored before they were
+	// added, so replace them all.
+	if _, err := tx.ExecContext(ctx, "delete from outage_place_overlaps"); err != nil {
+		return 0, 0, err
 	}
+	for id, g := range placed {
+		if _, err := tx.ExecContext(ctx, "delete from outage_places where outage_id=?", id); err != nil {
+			return 0, 0, err
+		}
+		if err := storePlacesExec(ctx, tx, id, g); err != nil {
+			return 0, 0, err
+		}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+		if slices.EqualFunc(old[id], g.Places, func(a, b outagePlace) bool { return a.Level == b.Level && a.Name == b.Name }) {
+			continue
+		}
+		changed++
+		if _, err := tx.ExecContext(ctx, "update outages set county=?, neighborhood=? where id=?", nullString(g.County), nullString(g.Neighborhood), id); err != nil {
+			return 0, 0, err
+		}
+		if _, err := tx.ExecContext(ctx, "update outage_summaries set county=?, neighborhood=? where id=?", nullString(g.County), nullString(g.Neighborhood), id); err != nil {
+			return 0, 0, err
+		}
 	}
 
-	return out, rows.Close()
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return changed, len(placed), nil
 }
 
-type storeObs struct {
-	tx *sql.Tx
-}
+// resetDerived deletes everything derived from snapshots, leaving
+// observations, snapshots and ingest_state for replaying.
+func (s *store) resetDerived(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-func (s storeObs) emit(to trackedOutage) (int, error) {
-	return storeEmitExec(s.tx, to)
-}
+	for _, table := range []string{"outage_cluster_members", "outage_links", "outage_events", "outage_summaries", "outage_place_overlaps", "outage_places", "outages"} {
+		if _, err := tx.ExecContext(ctx, "delete from "+table); err != nil {
+			return fmt.Errorf("resetting %s: %w", table, err)
+		}
+	}
 
-func (s storeObs) close() error {
-	return s.tx.Commit()
+	return tx.Commit()
 }
 
-func (s *store) beginObservation() (storeObservation, error) {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return nil, nil
+// archiveSource calls consume with the archived data of each of snaps,
+// as returned by store.archivedObservations.
+func archiveSource(ctx context.Context, st *store, snaps []snapshot, consume func(context.Context, snapshot, io.Reader) error) error {
+	for _, snap := range snaps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, err := st.archivedSnapshot(ctx, snap.Blob)
+		if err != nil {
+			return err
+		}
+		if err := consume(ctx, snap, r); err != nil {
+			return fmt.Errorf("observation %d: %w", snap.ObservationID, err)
+		}
 	}
-
-	return storeObs{tx: tx}, nil
+	return nil
 }
 
-func (s *store) emit(to trackedOutage) (int, error) {
-	return storeEmitExec(s.db, to)
+func (s *store) emit(ctx context.Context, to trackedOutage) (int, error) {
+	return storeEmitExec(ctx, s.db, to)
 }
 
-func storeEmitExec(execer interface {
-	Exec(string, ...any) (sql.Result, error)
+func storeEmitExec(ctx context.Context, execer interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
 }, to trackedOutage) (int, error) {
 	if to.ID == 0 {
-		var county, neighborhood, area *string
+		var county, neighborhood, areaPolyline, upstreamID *string
 		if c := to.Outage.Geom.County; c != "" {
 			county = &c
 		}
@@ -309,10 +1163,21 @@ func storeEmitExec(execer interface {
 			neighborhood = &n
 		}
 		if len(to.Outage.Geom.A) > 0 {
-			area = &to.Outage.Geom.A[0]
+			areaPolyline = &to.Outage.Geom.A[0]
+		}
+		if u := to.Outage.ID; u != "" {
+			upstreamID = &u
+		}
+		area, err := geometryJSON(to.Outage.Geom.Area)
+		if err != nil {
+			return 0, err
+		}
+		points, err := geometryJSON(to.Outage.Geom.Points)
+		if err != nil {
+			return 0, err
 		}
 
-		res, err := execer.Exec("insert into outages (longitude, latitude, county, neighborhood, area_polyline) values (?, ?, ?, ?, ?)", to.Outage.Geom.Lon, to.Outage.Geom.Lat, county, neighborhood, area)
+		res, err := execer.ExecContext(ctx, "insert into outages (longitude, latitude, county, neighborhood, area_polyline, upstream_id, area, points) values (?, ?, ?, ?, ?, ?, ?, ?)", to.Outage.Geom.Lon, to.Outage.Geom.Lat, county, neighborhood, areaPolyline, upstreamID, area, points)
 		if err != nil {
 			return 0, err
 		}
@@ -321,6 +1186,10 @@ func storeEmitExec(execer interface {
 			return 0, err
 		}
 		to.ID = int(id)
+
+		if err := storePlacesExec(ctx, execer, to.ID, to.Outage.Geom); err != nil {
+			return 0, err
+		}
 	}
 
 	le := to.Events[len(to.Events)-1]
@@ -331,49 +1200,176 @@ func storeEmitExec(execer interface {
 		cause = &to.Outage.Desc.Cause
 	}
 
-	_, err := execer.Exec(
-		"insert into outage_events (outage_id, observed_at, removed, cause, cust_aff, start, etr) values (?1, ?2, ?3, ?4, ?5, ?6, ?7)",
-		to.ID, le.ObservedAt.Format(time.RFC3339), removed, cause, to.Outage.Desc.CustA.Val, to.Outage.Desc.Start, to.Outage.Desc.ETR,
+	observedAt := le.ObservedAt.Format(time.RFC3339)
+	desc := to.Outage.Desc
+
+	// The area is only recorded when it changes to keep events small.
+	var area *string
+	var areaSqm *float64
+	if ga := to.Outage.Geom.Area; len(ga) > 0 {
+		a := geo.Area(ga)
+		areaSqm = &a
+	}
+	areaChanged := slices.Contains(le.Changes, "AreaChanged")
+	if le.Name == "Initial" || areaChanged {
+		a, err := geometryJSON(to.Outage.Geom.Area)
+		if err != nil {
+			return 0, err
+		}
+		if a == nil && areaChanged {
+			// Distinguish an area going away from an unchanged one.
+			e := `{"type":"MultiPolygon","coordinates":[]}`
+			a = &e
+		}
+		area = a
+	}
+
+	var changes *string
+	if len(le.Changes) > 0 {
+		c := strings.Join(le.Changes, ",")
+		changes = &c
+	}
+
+	_, err := execer.ExecContext(ctx,
+		"insert into outage_events (outage_id, observed_at, event, removed, cause, cust_aff, cust_aff_masked, start, etr, cluster, n_out, area, area_sqm, changes, observation_id) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		to.ID, observedAt, le.Name, removed, cause, desc.CustA.Val, desc.CustA.Masked, desc.Start, desc.ETR, desc.Cluster, desc.NOut, area, areaSqm, changes, nullInt(le.ObservationID),
 	)
 	if err != nil {
 		return 0, err
 	}
 
-	if _, err := execer.Exec("delete from outage_summaries where id=?", to.ID); err != nil {
+	for i, m := range desc.Outages {
+		var cause *string
+		if m.Cause != "" {
+			cause = &m.Cause
+		}
+
+		_, err := execer.ExecContext(ctx,
+			"insert into outage_cluster_members (outage_id, observed_at, member, cause, cust_aff, cust_aff_masked, start, etr) values (?, ?, ?, ?, ?, ?, ?, ?)",
+			to.ID, observedAt, i, cause, m.CustA.Val, m.CustA.Masked, m.Start, m.ETR,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := storeSummarizeExec(ctx, execer, to, removed, cause); err != nil {
 		return 0, err
 	}
 
+	return to.ID, nil
+}
+
+// storeExtendExec records the last event of to, which must be
+// unchanged from the previous one, by extending the previous one
+// rather than adding another.
+func storeExtendExec(ctx context.Context, execer interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, to trackedOutage) error {
+	le := to.Events[len(to.Events)-1]
+	observedAt := le.ObservedAt.Format(time.RFC3339)
+
+	_, err := execer.ExecContext(ctx,
+		"update outage_events set seen_until=?1, repeats=coalesce(repeats, 0)+1 where outage_id=?2 and observed_at=(select max(observed_at) from outage_events where outage_id=?2)",
+		observedAt, to.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Each repeat is an observation, masked if the event was.
+	_, err = execer.ExecContext(ctx,
+		"update outage_summaries set last_observed=max(last_observed, ?1), observations=observations+1, masked_observations=coalesce(masked_observations, 0)+?3 where id=?2",
+		observedAt, to.ID, to.Outage.Desc.CustA.Masked,
+	)
+	return err
+}
+
+// storeSummarizeExec folds the last event of to into its summary,
+// creating the summary if this is its first event. Events must be
+// emitted in observed order.
+func storeSummarizeExec(ctx context.Context, execer interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, to trackedOutage, removed bool, cause *string) error {
+	le := to.Events[len(to.Events)-1]
+	desc := to.Outage.Desc
+
+	// Masked counts aren't real counts, keep them out of min/max.
+	var custAff *int
+	if !desc.CustA.Masked {
+		custAff = &desc.CustA.Val
+	}
+
+	// Scalar min and max return null if any argument is null, so
+	// coalesce to whichever of the existing and new values is set.
 	q := `
-with
-summary as (
-  select
-    outage_id as id,
-    min(observed_at) as first_observed,
-    max(observed_at) as last_observed,
-    count(*) as observations,
-    min(cust_aff) as min_cust_aff,
-    max(cust_aff) as max_cust_aff,
-    min(start) as min_start,
-    max(etr) as max_etr
-  from outage_events
-  group by 1
-)
-insert into outage_summaries
-select
-summary.id,
-(select removed from outage_events where outage_id=summary.id and observed_at=last_observed),
-first_observed, last_observed, observations, min_cust_aff, max_cust_aff, min_start, max_etr,
-(select cause from outage_events where outage_id=summary.id and observed_at=last_observed),
-longitude, latitude, county, neighborhood
-from summary, outages
-where summary.id=? and summary.id=outages.id
+insert into outage_summaries (id, resolved, first_observed, last_observed, observations, min_cust_aff, max_cust_aff, masked_observations, min_start, max_etr, last_cause, longitude, latitude, county, neighborhood, was_cluster)
+select id, ?2, ?3, ?3, 1, ?4, ?4, ?5, ?6, ?7, ?8, longitude, latitude, county, neighborhood, ?9
+from outages
+where id=?1
+on conflict(id) do update set
+resolved=excluded.resolved,
+last_observed=max(last_observed, excluded.last_observed),
+observations=observations+1,
+min_cust_aff=coalesce(min(min_cust_aff, excluded.min_cust_aff), min_cust_aff, excluded.min_cust_aff),
+max_cust_aff=coalesce(max(max_cust_aff, excluded.max_cust_aff), max_cust_aff, excluded.max_cust_aff),
+masked_observations=masked_observations+excluded.masked_observations,
+min_start=coalesce(min(min_start, excluded.min_start), min_start, excluded.min_start),
+max_etr=coalesce(max(max_etr, excluded.max_etr), max_etr, excluded.max_etr),
+last_cause=excluded.last_cause,
+was_cluster=was_cluster or excluded.was_cluster
 `
 
-	if _, err := execer.Exec(q, to.ID); err != nil {
-		return 0, err
+	_, err := execer.ExecContext(ctx, q, to.ID, removed, le.ObservedAt.Format(time.RFC3339), custAff, desc.CustA.Masked, desc.Start, desc.ETR, cause, desc.Cluster)
+	return err
+}
+
+// nullString returns nil for empty s so it's stored as null.
+func nullString(s string) *string {
+	if s == "" {
+		return nil
 	}
+	return &s
+}
 
-	return to.ID, nil
+func nullInt(i int) *int {
+	if i == 0 {
+		return nil
+	}
+	return &i
+}
+
+func storePlacesExec(ctx context.Context, execer interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, outageID int, g outageGeom) error {
+	for _, p := range g.Places {
+		var placeID *int64
+		if p.PlaceID != 0 {
+			placeID = &p.PlaceID
+		}
+		if _, err := execer.ExecContext(ctx, "insert into outage_places (outage_id, level, name, place_id) values (?, ?, ?, ?)", outageID, p.Level, p.Name, placeID); err != nil {
+			return err
+		}
+	}
+	for _, o := range g.Overlaps {
+		if _, err := execer.ExecContext(ctx, "insert or ignore into outage_place_overlaps (outage_id, level, place_id, name, fraction) values (?, ?, ?, ?, ?)", outageID, o.Level, o.PlaceID, o.Name, o.Fraction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// geometryJSON returns g as GeoJSON, or nil if g is empty.
+func geometryJSON[G orb.MultiPoint | orb.MultiPolygon](g G) (*string, error) {
+	if len(g) == 0 {
+		return nil, nil
+	}
+	b, err := geojson.NewGeometry(orb.Geometry(g)).MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	return &s, nil
 }
 
 type weirdZoneTime struct{ time.Time }
@@ -451,8 +1447,55 @@ type outageGeom struct {
 	A            []string
 	P            []string
 	Lon, Lat     float64
+	Points       orb.MultiPoint   `json:"-"` // decoded P
+	Area         orb.MultiPolygon `json:"-"` // decoded A
 	County       string
 	Neighborhood string
+	Places       []outagePlace        `json:"-"` // by level, see placer
+	Overlaps     []outagePlaceOverlap `json:"-"` // by level, see placer
+}
+
+func (g outageGeom) point() orb.Point {
+	return orb.Point{g.Lon, g.Lat}
+}
+
+// decode sets g.Points, g.Lon and g.Lat from the encoded points in
+// g.P and g.Area from the encoded polylines in g.A.
+func (g *outageGeom) decode() error {
+	g.Points = nil
+	for _, p := range g.P {
+		coords, _, err := polyline.DecodeCoords([]byte(p))
+		if err != nil {
+			return fmt.Errorf("decoding geom.p %q: %w", p, err)
+		}
+		for _, c := range coords {
+			g.Points = append(g.Points, orb.Point{c[1], c[0]})
+		}
+	}
+	if len(g.Points) > 0 {
+		g.Lon, g.Lat = g.Points[0][0], g.Points[0][1]
+	}
+
+	g.Area = nil
+	for _, a := range g.A {
+		coords, _, err := polyline.DecodeCoords([]byte(a))
+		if err != nil {
+			return fmt.Errorf("decoding geom.a %q: %w", a, err)
+		}
+		if len(coords) < 3 {
+			continue
+		}
+
+		ring := make(orb.Ring, 0, len(coords)+1)
+		for _, c := range coords {
+			ring = append(ring, orb.Point{c[1], c[0]})
+		}
+		if !ring.Closed() {
+			ring = append(ring, ring[0])
+		}
+		g.Area = append(g.Area, orb.Polygon{ring})
+	}
+	return nil
 }
 
 type outage struct {
@@ -465,99 +1508,333 @@ type outage struct {
 type trackingEvent struct {
 	ObservedAt time.Time
 	Name       string
+	// ObservationID is the observations row the event was observed
+	// in. If 0, a storeObservation records it in its own.
+	ObservationID int
+	// How Outage differs from the previous event's, see
+	// classifyChanges. Only set for Update and Reappeared events.
+	Changes []string
 }
 
 type trackedOutage struct {
 	ID     int
 	Events []trackingEvent
 	Outage outage
+
+	// Set while the outage is absent but within the tracker's
+	// missing grace period.
+	missingSince    time.Time
+	missedSnapshots int
+	// The observations row missingSince is from.
+	missingObservationID int
 }
 
 type outageTracker struct {
-	st outageStore
-	// geom.Lon/Lat is key
-	known map[lonLatKey]trackedOutage
+	st      outageStore
+	matcher outageMatcher
+	grace   missingGrace
+	// Whether unchanged observations extend the previous event
+	// instead of emitting a new one.
+	skipUnchanged bool
+	// trackedOutage.ID is key
+	known map[int]trackedOutage
+
+	// New outages matching one resolved within recurrenceWindow by
+	// recurrenceMatcher are linked to it as recurrences.
+	recurrenceWindow  time.Duration
+	recurrenceMatcher outageMatcher
+	// Outages resolved within recurrenceWindow, trackedOutage.ID is
+	// key. The last event of each is its Missing event.
+	resolved map[int]trackedOutage
+
+	// When the last recorded observation was.
+	lastObservedAt time.Time
+
+	// If set, called to set the Overlaps of new outages before they
+	// are stored. Overlaps are only stored when an outage is first
+	// recorded, so they aren't worth computing for the rest.
+	placeOverlaps func(*outageGeom)
+}
+
+// missingGrace is how long an absent outage is held before it is
+// considered missing. An outage is held while it is within either
+// limit; the zero value holds nothing.
+type missingGrace struct {
+	snapshots int
+	duration  time.Duration
+}
+
+// holds reports whether to, absent from the observation at t, should
+// still be held.
+func (g missingGrace) holds(to trackedOutage, t time.Time) bool {
+	if g.snapshots > 0 && to.missedSnapshots <= g.snapshots {
+		return true
+	}
+	if g.duration > 0 && t.Sub(to.missingSince) <= g.duration {
+		return true
+	}
+	return false
 }
 
 type outageStore interface {
-	currentOutages() (map[int]trackedOutage, error)
-	beginObservation() (storeObservation, error)
-	emit(trackedOutage) (int, error)
+	lastObservedAt(context.Context) (time.Time, error)
+	// observationsAfter returns the observations observed after
+	// since, oldest first, with only their ObservedAt and
+	// ObservationID set.
+	observationsAfter(ctx context.Context, since time.Time) ([]snapshot, error)
+	currentOutages(context.Context) (map[int]trackedOutage, error)
+	recentlyResolved(ctx context.Context, since time.Time) (map[int]trackedOutage, error)
+	// beginObservation starts recording snap, which has outages
+	// outages. The observation is abandoned if ctx is done before it
+	// is closed.
+	beginObservation(ctx context.Context, snap snapshot, outages int) (storeObservation, error)
+	emit(context.Context, trackedOutage) (int, error)
 }
 
 type storeObservation interface {
-	emit(trackedOutage) (int, error)
-	close() error
+	// observationID returns the observations row being recorded.
+	observationID() int
+	emit(context.Context, trackedOutage) (int, error)
+	// extend records an unchanged observation without emitting a
+	// new event.
+	extend(context.Context, trackedOutage) error
+	link(ctx context.Context, id, linkedID int, kind string) error
+	// commit records everything in the observation. Either it or
+	// rollback must be called exactly once.
+	commit() error
+	// rollback abandons the observation, recording none of it.
+	rollback() error
 }
 
-func newOutageTracker(st outageStore) *outageTracker {
-	return &outageTracker{st: st, known: make(map[lonLatKey]trackedOutage)}
+func newOutageTracker(st outageStore, matcher outageMatcher) *outageTracker {
+	return &outageTracker{st: st, matcher: matcher, recurrenceMatcher: newRecurrenceMatcher(matcher), known: make(map[int]trackedOutage), resolved: make(map[int]trackedOutage)}
 }
 
-func (o *outageTracker) loadState() error {
-	co, err := o.st.currentOutages()
+func (o *outageTracker) loadState(ctx context.Context) error {
+	co, err := o.st.currentOutages(ctx)
+	if err != nil {
+		return err
+	}
+
+	last, err := o.st.lastObservedAt(ctx)
 	if err != nil {
 		return err
 	}
 
+	o.lastObservedAt = last
+
+	// Outages absent from observations since they were last seen
+	// were within their grace period. Hold them as they were.
+	var since time.Time
 	for _, to := range co {
-		o.known[lonLatKey{to.Outage.Geom.Lon, to.Outage.Geom.Lat}] = to
+		if seen := to.Events[len(to.Events)-1].ObservedAt; since.IsZero() || seen.Before(since) {
+			since = seen
+		}
+	}
+	var after []snapshot
+	if len(co) > 0 {
+		if after, err = o.st.observationsAfter(ctx, since); err != nil {
+			return err
+		}
 	}
 
-	return nil
-}
+	for id, to := range co {
+		seen := to.Events[len(to.Events)-1].ObservedAt
+		if i := slices.IndexFunc(after, func(s snapshot) bool { return s.ObservedAt.After(seen) }); i >= 0 {
+			to.missingSince = after[i].ObservedAt
+			to.missingObservationID = after[i].ObservationID
+			to.missedSnapshots = len(after) - i
+		} else if seen.Before(last) {
+			// Seen before observations were recorded, so which it
+			// was absent from isn't known. Hold it as if only the
+			// last.
+			to.missingSince = last
+			to.missedSnapshots = 1
+		}
+		o.known[id] = to
+	}
+
+	if o.recurrenceWindow > 0 && !last.IsZero() {
+		rr, err := o.st.recentlyResolved(ctx, last.Add(-o.recurrenceWindow))
+		if err != nil {
+			return err
+		}
+		maps.Copy(o.resolved, rr)
+	}
 
-type lonLatKey struct {
-	lon, lat float64
+	return nil
 }
 
-func (o *outageTracker) observe(t time.Time, outages []outage) error {
+func (o *outageTracker) observe(ctx context.Context, snap snapshot, outages []outage) error {
+	t := snap.ObservedAt
+	// Events are stored to the second and keyed by outage and time, so
+	// a snapshot can't be recorded in the same second as (or before)
+	// the last one. Keep the first, later snapshots will catch up.
+	if !o.lastObservedAt.IsZero() && !t.Truncate(time.Second).After(o.lastObservedAt.Truncate(time.Second)) {
+		log.Println("tracker.observe skipping snapshot", snap.Commit, snap.Blob, "observed at", t.Format(time.RFC3339), "as it is not after the last observation at", o.lastObservedAt.Format(time.RFC3339))
+		return nil
+	}
 	log.Println("tracker.observe time", t.Format(time.RFC3339), "knowing", len(o.known), "and observing", len(outages), "outages")
 
-	so, err := o.st.beginObservation()
+	so, err := o.st.beginObservation(ctx, snap, len(outages))
+	if err != nil {
+		return err
+	}
+
+	// Work on copies so that if the observation fails the tracker is
+	// left as it was, matching the store.
+	known, resolved := o.known, o.resolved
+	o.known, o.resolved = maps.Clone(known), maps.Clone(resolved)
+
+	err = o.apply(ctx, so, t, outages)
+	if err == nil {
+		err = so.commit()
+	} else if rerr := so.rollback(); rerr != nil {
+		err = errors.Join(err, fmt.Errorf("rolling back: %w", rerr))
+	}
 	if err != nil {
+		o.known, o.resolved = known, resolved
 		return err
 	}
-	defer so.close()
+	o.lastObservedAt = t
+	return nil
+}
+
+// apply updates the tracker and records events in so for outages
+// observed at t.
+func (o *outageTracker) apply(ctx context.Context, so storeObservation, t time.Time, outages []outage) error {
+	for id, ro := range o.resolved {
+		if t.Sub(ro.Events[len(ro.Events)-1].ObservedAt) > o.recurrenceWindow {
+			delete(o.resolved, id)
+		}
+	}
+
+	// Held outages that would reappear outside the grace period are
+	// missing rather than candidates for matching.
+	for _, ko := range o.known {
+		if !ko.missingSince.IsZero() && !o.grace.holds(ko, t) {
+			if err := o.missing(ctx, so, ko); err != nil {
+				return err
+			}
+		}
+	}
 
-	ui := make(map[lonLatKey]bool)
-nextOutage:
+	// Known outages not yet matched by one in this observation.
+	unmatched := maps.Clone(o.known)
+	candidates := o.matcher.candidates(unmatched)
+	recurrences := o.recurrenceMatcher.candidates(o.resolved)
 	for _, out := range outages {
-		key := lonLatKey{out.Geom.Lon, out.Geom.Lat}
-		k, ok := o.known[key]
-		if ok {
-			k.Events = append(k.Events, trackingEvent{ObservedAt: t, Name: "Update"})
+		if id, ok := candidates.match(out); ok {
+			k := unmatched[id]
+			delete(unmatched, id)
+			candidates.remove(id)
+			name := "Update"
+			if !k.missingSince.IsZero() {
+				name = "Reappeared"
+				k.missingSince, k.missingObservationID, k.missedSnapshots = time.Time{}, 0, 0
+			}
+			changes := classifyChanges(k.Outage, out)
+			k.Events = append(k.Events, trackingEvent{ObservedAt: t, Name: name, Changes: changes})
 			k.Outage = out
-			o.known[key] = k
-			if _, err := so.emit(k); err != nil {
+			o.known[id] = k
+			if o.skipUnchanged && name == "Update" && changes[0] == "Unchanged" {
+				if err := so.extend(ctx, k); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := so.emit(ctx, k); err != nil {
 				return err
 			}
-			ui[key] = true
-			continue nextOutage
+			continue
 		}
 
+		if o.placeOverlaps != nil {
+			o.placeOverlaps(&out.Geom)
+		}
 		to := trackedOutage{Events: []trackingEvent{{ObservedAt: t, Name: "Initial"}}, Outage: out}
-		id, err := so.emit(to)
+		id, err := so.emit(ctx, to)
 		if err != nil {
 			return err
 		}
 		to.ID = id
-		o.known[key] = to
-		ui[key] = true
-	}
+		o.known[id] = to
 
-	for ki, ko := range o.known {
-		if !ui[ki] {
-			ko := ko
-			ko.Events = append(ko.Events, trackingEvent{ObservedAt: t, Name: "Missing"})
-			if _, err := so.emit(ko); err != nil {
+		if rid, ok := recurrences.match(out); ok {
+			if err := so.link(ctx, id, rid, "recurrence"); err != nil {
 				return err
 			}
-			delete(o.known, ki)
+			// Any further recurrence links to this outage instead.
+			delete(o.resolved, rid)
+			recurrences.remove(rid)
+		}
+	}
+
+	for id, ko := range unmatched {
+		if ko.missingSince.IsZero() {
+			ko.missingSince = t
+			ko.missingObservationID = so.observationID()
+		}
+		ko.missedSnapshots++
+		if o.grace.holds(ko, t) {
+			o.known[id] = ko
+			continue
+		}
+
+		if err := o.missing(ctx, so, ko); err != nil {
+			return err
 		}
 	}
 
-	return so.close()
+	return nil
+}
+
+// classifyChanges returns how cur differs from prev as one or more of
+// ETRChanged, CauseChanged, CustomersChanged, StartChanged,
+// ClusterChanged and AreaChanged, or only Unchanged.
+func classifyChanges(prev, cur outage) []string {
+	var changes []string
+	if !prev.Desc.ETR.Equal(cur.Desc.ETR.Time) {
+		changes = append(changes, "ETRChanged")
+	}
+	if prev.Desc.Cause != cur.Desc.Cause {
+		changes = append(changes, "CauseChanged")
+	}
+	if prev.Desc.CustA != cur.Desc.CustA {
+		changes = append(changes, "CustomersChanged")
+	}
+	if !prev.Desc.Start.Equal(cur.Desc.Start.Time) {
+		changes = append(changes, "StartChanged")
+	}
+	if prev.Desc.Cluster != cur.Desc.Cluster || prev.Desc.NOut != cur.Desc.NOut || !slices.EqualFunc(prev.Desc.Outages, cur.Desc.Outages, clusterMemberEqual) {
+		changes = append(changes, "ClusterChanged")
+	}
+	if !orb.Equal(prev.Geom.Area, cur.Geom.Area) {
+		changes = append(changes, "AreaChanged")
+	}
+	if len(changes) == 0 {
+		changes = append(changes, "Unchanged")
+	}
+	return changes
+}
+
+func clusterMemberEqual(a, b outageDesc) bool {
+	return a.Cause == b.Cause && a.CustA == b.CustA && a.Start.Equal(b.Start.Time) && a.ETR.Equal(b.ETR.Time)
+}
+
+// missing emits a Missing event for to and forgets it. The event is
+// recorded at the first observation to was absent from, as if there
+// were no grace period.
+func (o *outageTracker) missing(ctx context.Context, so storeObservation, to trackedOutage) error {
+	to.Events = append(to.Events, trackingEvent{ObservedAt: to.missingSince, Name: "Missing", ObservationID: to.missingObservationID})
+	if _, err := so.emit(ctx, to); err != nil {
+		return err
+	}
+	delete(o.known, to.ID)
+	if o.recurrenceWindow > 0 {
+		o.resolved[to.ID] = to
+	}
+	return nil
 }
 
 //go:embed places/ns-featurecollection.json
@@ -583,60 +1860,164 @@ func loadPlaces(path string) (*geojson.FeatureCollection, error) {
 	return fc, nil
 }
 
+// placer is safe for concurrent use.
 type placer struct {
-	places      *geojson.FeatureCollection
+	places  *geojson.FeatureCollection
+	levels  []placeLevel
+	index   placeIndex
+	records []placeRecord       // parallel to places.Features
+	tris    [][]overlapTriangle // parallel to places.Features, for polygons
+	ids     map[*geojson.Feature]int64
+
+	mu          sync.RWMutex
 	ptFeatCache map[orb.Point][]*geojson.Feature
 }
 
-func newPlacer(places *geojson.FeatureCollection) *placer {
-	return &placer{places: places, ptFeatCache: make(map[orb.Point][]*geojson.Feature)}
+func newPlacer(places *geojson.FeatureCollection, levels []placeLevel) (*placer, error) {
+	p := &placer{
+		places:      places,
+		levels:      levels,
+		index:       newPlaceIndex(places.Features),
+		ids:         make(map[*geojson.Feature]int64, len(places.Features)),
+		ptFeatCache: make(map[orb.Point][]*geojson.Feature),
+	}
+	for _, f := range places.Features {
+		r, err := newPlaceRecord(f, levels)
+		if err != nil {
+			return nil, err
+		}
+		p.records = append(p.records, r)
+		p.ids[f] = r.ID
+
+		var tris []overlapTriangle
+		switch g := f.Geometry.(type) {
+		case orb.Polygon:
+			tris = overlapTriangles(orb.MultiPolygon{g})
+		case orb.MultiPolygon:
+			tris = overlapTriangles(g)
+		}
+		p.tris = append(p.tris, tris)
+	}
+	return p, nil
 }
 
+// place decodes the geometry of outages and sets their Places by
+// point. Overlaps are left to placeOverlaps, since they're only stored
+// for new outages.
 func (p *placer) place(outages []outage) error {
 	for i, out := range outages {
-		ps := out.Geom.P
-		if len(ps) == 0 {
-			continue
+		if err := out.Geom.decode(); err != nil {
+			return err
 		}
+		p.placePoints(&out.Geom)
+		outages[i] = out
+	}
 
-		coord, _, err := polyline.DecodeCoord([]byte(ps[0]))
-		if err != nil {
-			return fmt.Errorf("decoding geom.p %q: %w", ps[0], err)
-		}
+	return nil
+}
 
-		out.Geom.Lon, out.Geom.Lat = coord[1], coord[0]
+// placeGeom sets all of g's places from its decoded geometry.
+func (p *placer) placeGeom(g *outageGeom) {
+	p.placePoints(g)
+	p.placeOverlaps(g)
+}
 
-		pt := orb.Point{coord[1], coord[0]}
-		feats, ok := p.ptFeatCache[pt]
-		if !ok {
-			for _, f := range p.places.Features {
-				if isPointWithinFeature(pt, f) {
-					feats = append(feats, f)
-				}
+// placePoints sets g's Places by its point, if it has one.
+func (p *placer) placePoints(g *outageGeom) {
+	g.County, g.Neighborhood, g.Places = "", "", nil
+	if len(g.Points) > 0 {
+		p.placePoint(g)
+	}
+}
+
+// placeOverlaps sets g's Overlaps by its area, or by its Places if it
+// has no area.
+func (p *placer) placeOverlaps(g *outageGeom) {
+	g.Overlaps = nil
+	if len(g.Area) > 0 {
+		g.Overlaps = p.areaOverlaps(g.Area)
+		return
+	}
+	for _, pl := range g.Places {
+		g.Overlaps = append(g.Overlaps, outagePlaceOverlap{Level: pl.Level, Name: pl.Name, PlaceID: pl.PlaceID, Fraction: 1})
+	}
+}
+
+func (p *placer) placePoint(g *outageGeom) {
+	feats := p.features(g.point())
+	for _, l := range p.levels {
+		var best *geojson.Feature
+		for _, f := range feats {
+			if l.matches(f) {
+				best = l.pick(best, f)
 			}
-			p.ptFeatCache[pt] = feats
 		}
-		var neighborhoodArea float64
-		for _, f := range feats {
-			name := f.Properties.MustString("wof:name")
-			placeType := f.Properties.MustString("wof:placetype")
-
-			switch placeType {
-			case "county":
-				out.Geom.County = name
-			case "neighbourhood": // whosonfirst spelling
-				// Prefer smallest neighborhood match.
-				if fa := planar.Area(f.Geometry); neighborhoodArea == 0 || fa < neighborhoodArea {
-					out.Geom.Neighborhood = name
-					neighborhoodArea = fa
-				}
+		if best == nil {
+			continue
+		}
+		name := l.name(best)
+		if name == "" {
+			continue
+		}
+
+		g.Places = append(g.Places, outagePlace{Level: l.Level, Name: name, PlaceID: p.ids[best]})
+		switch l.Level {
+		case "county":
+			g.County = name
+		case "neighborhood":
+			g.Neighborhood = name
+		}
+	}
+}
+
+// areaOverlaps returns the places at each level that area overlaps.
+func (p *placer) areaOverlaps(area orb.MultiPolygon) []outagePlaceOverlap {
+	tris := overlapTriangles(area)
+	total := trianglesArea(tris)
+	if total <= 0 {
+		return nil
+	}
+	var overlaps []outagePlaceOverlap
+	cands := p.index.overlapping(area.Bound())
+	for _, l := range p.levels {
+		for _, i := range cands {
+			f := p.places.Features[i]
+			if len(p.tris[i]) == 0 || !l.matches(f) {
+				continue
+			}
+			name := l.name(f)
+			if name == "" {
+				continue
 			}
+			frac := overlapArea(tris, p.tris[i]) / total
+			if frac < minOverlapFraction {
+				continue
+			}
+			overlaps = append(overlaps, outagePlaceOverlap{Level: l.Level, Name: name, PlaceID: p.ids[f], Fraction: min(frac, 1)})
 		}
+	}
+	return overlaps
+}
 
-		outages[i] = out
+// features returns the features containing pt.
+func (p *placer) features(pt orb.Point) []*geojson.Feature {
+	p.mu.RLock()
+	feats, ok := p.ptFeatCache[pt]
+	p.mu.RUnlock()
+	if ok {
+		return feats
 	}
 
-	return nil
+	for _, i := range p.index.candidates(pt) {
+		if f := p.places.Features[i]; isPointWithinFeature(pt, f) {
+			feats = append(feats, f)
+		}
+	}
+
+	p.mu.Lock()
+	p.ptFeatCache[pt] = feats
+	p.mu.Unlock()
+	return feats
 }
 
 // https://golangcode.com/is-point-within-polygon-from-geojson/
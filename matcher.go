@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/planar"
+)
+
+// outageMatcher decides which known outage, if any, an observed
+// outage is a continuation of.
+type outageMatcher interface {
+	// candidates returns the outages in cands for matching observed
+	// outages against. It doesn't keep or modify cands.
+	candidates(cands map[int]trackedOutage) matchCandidates
+}
+
+// matchCandidates are the outages an outageMatcher matches against.
+type matchCandidates interface {
+	// match returns the ID of the candidate that out continues, or
+	// false if out is a new outage.
+	match(out outage) (int, bool)
+	// remove stops the candidate with ID id being matched.
+	remove(id int)
+}
+
+func newOutageMatcher(strategy string, distance float64) (outageMatcher, error) {
+	switch strategy {
+	case "lonlat":
+		return lonLatMatcher{}, nil
+	case "id":
+		return idMatcher{}, nil
+	case "distance":
+		if distance <= 0 {
+			return nil, fmt.Errorf("match distance must be positive, got %v", distance)
+		}
+		return distanceMatcher{maxMeters: distance}, nil
+	case "area":
+		return areaMatcher{}, nil
+	}
+	return nil, fmt.Errorf("unknown match strategy %q", strategy)
+}
+
+// newRecurrenceMatcher returns the matcher for finding which resolved
+// outage a new one recurs. A new outage has a new upstream ID and maybe
+// a different area, so recurrences are matched by location: within
+// m's distance if it's a distanceMatcher, otherwise exactly.
+func newRecurrenceMatcher(m outageMatcher) outageMatcher {
+	if dm, ok := m.(distanceMatcher); ok {
+		return dm
+	}
+	return lonLatMatcher{}
+}
+
+// lonLatMatcher matches outages whose decoded geom.p points are
+// exactly equal.
+type lonLatMatcher struct{}
+
+func (lonLatMatcher) candidates(cands map[int]trackedOutage) matchCandidates {
+	c := &lonLatCandidates{byPoint: make(candidateIndex[orb.Point]), points: make(map[int]orb.Point, len(cands))}
+	for id, to := range cands {
+		c.add(id, to)
+	}
+	return c
+}
+
+// lonLatCandidates indexes candidates by point.
+type lonLatCandidates struct {
+	byPoint candidateIndex[orb.Point]
+	points  map[int]orb.Point
+}
+
+func (c *lonLatCandidates) add(id int, to trackedOutage) {
+	pt := to.Outage.Geom.point()
+	c.byPoint.add(pt, id)
+	c.points[id] = pt
+}
+
+func (c *lonLatCandidates) match(out outage) (int, bool) {
+	return c.byPoint.first(out.Geom.point())
+}
+
+func (c *lonLatCandidates) remove(id int) {
+	if pt, ok := c.points[id]; ok {
+		c.byPoint.remove(pt, id)
+		delete(c.points, id)
+	}
+}
+
+// idMatcher matches outages by their upstream ID, falling back to
+// lonLatMatcher for outages without one.
+type idMatcher struct{}
+
+func (idMatcher) candidates(cands map[int]trackedOutage) matchCandidates {
+	c := &idCandidates{
+		lonLat: lonLatMatcher{}.candidates(cands).(*lonLatCandidates),
+		byID:   make(candidateIndex[string]),
+		ids:    make(map[int]string),
+	}
+	for id, to := range cands {
+		if u := to.Outage.ID; u != "" {
+			c.byID.add(u, id)
+			c.ids[id] = u
+		}
+	}
+	return c
+}
+
+// idCandidates indexes candidates by upstream ID, and by point for
+// outages without one.
+type idCandidates struct {
+	lonLat *lonLatCandidates
+	byID   candidateIndex[string]
+	ids    map[int]string
+}
+
+func (c *idCandidates) match(out outage) (int, bool) {
+	if out.ID == "" {
+		return c.lonLat.match(out)
+	}
+	return c.byID.first(out.ID)
+}
+
+func (c *idCandidates) remove(id int) {
+	c.lonLat.remove(id)
+	if u, ok := c.ids[id]; ok {
+		c.byID.remove(u, id)
+		delete(c.ids, id)
+	}
+}
+
+// candidateIndex maps keys to the IDs of the candidates with them,
+// lowest first to match bestCandidate's tie breaking.
+type candidateIndex[K comparable] map[K][]int
+
+func (x candidateIndex[K]) add(k K, id int) {
+	ids := x[k]
+	i, _ := slices.BinarySearch(ids, id)
+	x[k] = slices.Insert(ids, i, id)
+}
+
+func (x candidateIndex[K]) remove(k K, id int) {
+	ids := x[k]
+	if i, ok := slices.BinarySearch(ids, id); ok {
+		ids = slices.Delete(ids, i, i+1)
+	}
+	if len(ids) == 0 {
+		delete(x, k)
+		return
+	}
+	x[k] = ids
+}
+
+func (x candidateIndex[K]) first(k K) (int, bool) {
+	if ids := x[k]; len(ids) > 0 {
+		return ids[0], true
+	}
+	return 0, false
+}
+
+// distanceMatcher matches the nearest outage within maxMeters.
+type distanceMatcher struct {
+	maxMeters float64
+}
+
+func (m distanceMatcher) candidates(cands map[int]trackedOutage) matchCandidates {
+	return scanCandidates{cands: maps.Clone(cands), best: m.best}
+}
+
+func (m distanceMatcher) best(out outage, cands map[int]trackedOutage) (int, bool) {
+	pt := out.Geom.point()
+	return bestCandidate(cands, func(to trackedOutage) (float64, bool) {
+		d := geo.Distance(pt, to.Outage.Geom.point())
+		return d, d <= m.maxMeters
+	})
+}
+
+// areaMatcher matches outages whose areas overlap, preferring the one
+// with the nearest point. Outages without an area fall back to
+// lonLatMatcher.
+type areaMatcher struct{}
+
+func (m areaMatcher) candidates(cands map[int]trackedOutage) matchCandidates {
+	return scanCandidates{cands: maps.Clone(cands), best: m.best}
+}
+
+func (areaMatcher) best(out outage, cands map[int]trackedOutage) (int, bool) {
+	if len(out.Geom.Area) == 0 {
+		return bestCandidate(cands, func(to trackedOutage) (float64, bool) {
+			return 0, to.Outage.Geom.point() == out.Geom.point()
+		})
+	}
+	pt := out.Geom.point()
+	return bestCandidate(cands, func(to trackedOutage) (float64, bool) {
+		if !multiPolygonsOverlap(out.Geom.Area, to.Outage.Geom.Area) {
+			return 0, false
+		}
+		return geo.Distance(pt, to.Outage.Geom.point()), true
+	})
+}
+
+// scanCandidates matches by scanning every candidate with best, for
+// matchers that can't be indexed by an exact key.
+type scanCandidates struct {
+	cands map[int]trackedOutage
+	best  func(out outage, cands map[int]trackedOutage) (int, bool)
+}
+
+func (c scanCandidates) match(out outage) (int, bool) {
+	return c.best(out, c.cands)
+}
+
+func (c scanCandidates) remove(id int) {
+	delete(c.cands, id)
+}
+
+// bestCandidate returns the ID of the candidate with the lowest score
+// that is ok, using the lowest ID to break ties so results don't
+// depend on map order.
+func bestCandidate(candidates map[int]trackedOutage, score func(trackedOutage) (float64, bool)) (int, bool) {
+	bestID, bestScore := 0, math.Inf(1)
+	for id, to := range candidates {
+		s, ok := score(to)
+		if !ok {
+			continue
+		}
+		if s < bestScore || (s == bestScore && id < bestID) {
+			bestID, bestScore = id, s
+		}
+	}
+	return bestID, bestID != 0
+}
+
+func multiPolygonsOverlap(a, b orb.MultiPolygon) bool {
+	if len(a) == 0 || len(b) == 0 || !a.Bound().Intersects(b.Bound()) {
+		return false
+	}
+	for _, pa := range a {
+		for _, pb := range b {
+			if polygonsOverlap(pa, pb) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// polygonsOverlap reports whether the outer rings of a and b share
+// any area: either one contains a vertex of the other or their edges
+// cross.
+func polygonsOverlap(a, b orb.Polygon) bool {
+	if len(a) == 0 || len(b) == 0 || !a.Bound().Intersects(b.Bound()) {
+		return false
+	}
+	ra, rb := a[0], b[0]
+	for _, p := range ra {
+		if planar.RingContains(rb, p) {
+			return true
+		}
+	}
+	for _, p := range rb {
+		if planar.RingContains(ra, p) {
+			return true
+		}
+	}
+	for i := 1; i < len(ra); i++ {
+		for j := 1; j < len(rb); j++ {
+			if segmentsIntersect(ra[i-1], ra[i], rb[j-1], rb[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func segmentsIntersect(p1, p2, p3, p4 orb.Point) bool {
+	d1 := cross(p3, p4, p1)
+	d2 := cross(p3, p4, p2)
+	d3 := cross(p1, p2, p3)
+	d4 := cross(p1, p2, p4)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+// cross returns the z component of (b-a) x (c-a).
+func cross(a, b, c orb.Point) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
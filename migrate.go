@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	"github.com/twpayne/go-polyline"
+)
+
+// migration upgrades the schema by one version.
+type migration func(tx *sql.Tx) error
+
+// migrations upgrade the schema from PRAGMA user_version i to i+1.
+// Only ever append to this list, released databases may be at any
+// version.
+//
+// Databases created before versioning are at version 0 but have some
+// or all of the tables, so migrations must tolerate what an
+// unversioned build may already have created.
+var migrations = []migration{
+	// 1: schema before versioning.
+	execMigration(
+		"create table if not exists outages (id integer primary key, longitude numeric, latitude numeric, county text, neighborhood text, area_polyline text)",
+		"create table if not exists outage_events (outage_id integer references outages on delete cascade, observed_at datetime, removed bool, cause text, cust_aff int, start datetime, etr datetime, primary key(outage_id, observed_at))",
+		"create table if not exists outage_summaries (id integer primary key references outages on delete cascade, resolved bool, first_observed datetime, last_observed datetime, observations int, min_cust_aff int, max_cust_aff int, min_start datetime, max_etr datetime, last_cause text, longitude numeric, latitude numeric, county text, neighborhood text)",
+		"create index if not exists outage_summaries_unresolved on outage_summaries (id, last_observed) where resolved=0",
+	),
+	// 2: upstream outage IDs and event names.
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "outages", "upstream_id", "text"); err != nil {
+			return err
+		}
+		added, err := addColumnReport(tx, "outage_events", "event", "text")
+		if err != nil || !added {
+			return err
+		}
+		_, err = tx.Exec(`
+update outage_events set event=case
+  when removed then 'Missing'
+  when observed_at=(select min(observed_at) from outage_events e where e.outage_id=outage_events.outage_id) then 'Initial'
+  else 'Update'
+end`)
+		return err
+	},
+	// 3: recurrence links.
+	execMigration(
+		"create table if not exists outage_links (outage_id integer references outages on delete cascade, linked_outage_id integer references outages on delete cascade, kind text, primary key(outage_id, linked_outage_id, kind))",
+	),
+	// 4: clusters.
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "outage_events", "cluster", "bool"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "outage_events", "n_out", "int"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "outage_summaries", "was_cluster", "bool default 0"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("create table if not exists outage_cluster_members (outage_id integer, observed_at datetime, member int, cause text, cust_aff int, start datetime, etr datetime, primary key(outage_id, observed_at, member), foreign key(outage_id, observed_at) references outage_events on delete cascade)")
+		return err
+	},
+	// 5: masked customer counts.
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "outage_events", "cust_aff_masked", "bool"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "outage_cluster_members", "cust_aff_masked", "bool"); err != nil {
+			return err
+		}
+		return addColumn(tx, "outage_summaries", "masked_observations", "int default 0")
+	},
+	// 6: full outage geometry.
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "outages", "points", "text"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "outage_events", "area_sqm", "real"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "outage_events", "area", "text"); err != nil {
+			return err
+		}
+		added, err := addColumnReport(tx, "outages", "area", "text")
+		if err != nil || !added {
+			return err
+		}
+		return backfillGeometry(tx)
+	},
+	// 7: change classification and extended events.
+	func(tx *sql.Tx) error {
+		if err := addColumn(tx, "outage_events", "changes", "text"); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "outage_events", "seen_until", "datetime"); err != nil {
+			return err
+		}
+		return addColumn(tx, "outage_events", "repeats", "int")
+	},
+	// 8: where each source left off.
+	execMigration(
+		"create table if not exists ingest_state (source text primary key, commit_hash text, blob_hash text, observed_at datetime)",
+	),
+	// 9: observation provenance.
+	func(tx *sql.Tx) error {
+		if _, err := tx.Exec("create table if not exists observations (id integer primary key, observed_at datetime, source text, commit_hash text, blob_hash text, author text, message text, outage_count int)"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("create index if not exists observations_observed_at on observations (observed_at)"); err != nil {
+			return err
+		}
+		return addColumn(tx, "outage_events", "observation_id", "integer references observations")
+	},
+	// 10: raw snapshot archive.
+	execMigration(
+		"create table if not exists snapshots (blob_hash text primary key, encoding text, data blob)",
+	),
+	// 11: places at configurable levels.
+	execMigration(
+		"create table if not exists outage_places (outage_id integer references outages on delete cascade, level text, name text, primary key(outage_id, level))",
+		"insert or ignore into outage_places (outage_id, level, name) select id, 'county', county from outages where county is not null",
+		"insert or ignore into outage_places (outage_id, level, name) select id, 'neighborhood', neighborhood from outages where neighborhood is not null",
+	),
+	// 12: places table.
+	func(tx *sql.Tx) error {
+		if _, err := tx.Exec("create table if not exists places (id integer primary key, placetype text, name text, parent_id integer, geometry text)"); err != nil {
+			return err
+		}
+		return addColumn(tx, "outage_places", "place_id", "integer references places")
+	},
+	// 13: area-weighted places.
+	execMigration(
+		"create table if not exists outage_place_overlaps (outage_id integer references outages on delete cascade, level text, place_id integer references places, name text, fraction real, primary key(outage_id, level, place_id))",
+	),
+}
+
+// migrate upgrades the database to the latest schema version in a
+// single transaction.
+func migrate(db *sql.DB) error {
+	return migrateTo(db, len(migrations))
+}
+
+func migrateTo(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err := tx.QueryRow("pragma user_version").Scan(&current); err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d", current, len(migrations))
+	}
+
+	for v := current; v < version; v++ {
+		if err := migrations[v](tx); err != nil {
+			return fmt.Errorf("migrating to version %d: %w", v+1, err)
+		}
+	}
+
+	if version > current {
+		// pragma doesn't take bind parameters.
+		if _, err := tx.Exec(fmt.Sprintf("pragma user_version = %d", version)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func execMigration(stmts ...string) migration {
+	return func(tx *sql.Tx) error {
+		for _, s := range stmts {
+			if _, err := tx.Exec(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds column to table unless it already exists.
+func addColumn(tx *sql.Tx, table, column, def string) error {
+	_, err := addColumnReport(tx, table, column, def)
+	return err
+}
+
+// addColumnReport is addColumn but also reports whether the column
+// was added, so callers can backfill it.
+func addColumnReport(tx *sql.Tx, table, column, def string) (bool, error) {
+	var exists bool
+	if err := tx.QueryRow("select count(*) > 0 from pragma_table_info(?) where name=?", table, column).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+	_, err := tx.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, def))
+	return err == nil, err
+}
+
+// backfillGeometry fills outages.area and outages.points from what
+// was kept before full geometry was stored: the first area polyline
+// and the first point. The area is also recorded on the Initial event
+// since that's the only one it's known for.
+//
+// It decodes and encodes geometry itself, as it was at version 6,
+// rather than with outageGeom and geometryJSON so that changing them
+// doesn't change what the migration writes.
+func backfillGeometry(tx *sql.Tx) error {
+	rows, err := tx.Query("select id, longitude, latitude, area_polyline from outages")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type backfill struct {
+		id           int
+		area, points *string
+		areaSqm      *float64
+	}
+	var bs []backfill
+	for rows.Next() {
+		var id int
+		var lon, lat sql.NullFloat64
+		var areaPolyline sql.NullString
+		if err := rows.Scan(&id, &lon, &lat, &areaPolyline); err != nil {
+			return err
+		}
+
+		b := backfill{id: id}
+		if lon.Valid && lat.Valid {
+			if b.points, err = backfillGeoJSON(orb.MultiPoint{{lon.Float64, lat.Float64}}); err != nil {
+				return err
+			}
+		}
+		if areaPolyline.Valid {
+			coords, _, err := polyline.DecodeCoords([]byte(areaPolyline.String))
+			if err != nil {
+				return fmt.Errorf("outage %d: decoding area polyline %q: %w", id, areaPolyline.String, err)
+			}
+			if len(coords) >= 3 {
+				ring := make(orb.Ring, 0, len(coords)+1)
+				for _, c := range coords {
+					ring = append(ring, orb.Point{c[1], c[0]})
+				}
+				if !ring.Closed() {
+					ring = append(ring, ring[0])
+				}
+				area := orb.MultiPolygon{{ring}}
+				if b.area, err = backfillGeoJSON(area); err != nil {
+					return err
+				}
+				a := geo.Area(area)
+				b.areaSqm = &a
+			}
+		}
+		bs = append(bs, b)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, b := range bs {
+		if _, err := tx.Exec("update outages set area=?, points=? where id=?", b.area, b.points, b.id); err != nil {
+			return err
+		}
+		if b.area == nil {
+			continue
+		}
+		if _, err := tx.Exec("update outage_events set area=?1, area_sqm=?2 where outage_id=?3 and observed_at=(select min(observed_at) from outage_events where outage_id=?3)", b.area, b.areaSqm, b.id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func backfillGeoJSON(g orb.Geometry) (*string, error) {
+	b, err := geojson.NewGeometry(g).MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	return &s, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to file::memory: is its own database.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func loadBaselineFixture(t *testing.T, db *sql.DB) {
+	t.Helper()
+	b, err := os.ReadFile("testdata/baseline.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	execFixture(t, db, string(b))
+}
+
+var fixtureVersionRE = regexp.MustCompile(`(?m)^-- version (\d+).*$`)
+
+// loadVersionedFixture fills in the columns added up to version for
+// the baseline fixture's rows.
+func loadVersionedFixture(t *testing.T, db *sql.DB, version int) {
+	t.Helper()
+	b, err := os.ReadFile("testdata/versioned.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := fixtureVersionRE.Split(string(b), -1)
+	for i, m := range fixtureVersionRE.FindAllStringSubmatch(string(b), -1) {
+		if v, _ := strconv.Atoi(m[1]); v <= version {
+			execFixture(t, db, sections[i+1])
+		}
+	}
+}
+
+func execFixture(t *testing.T, db *sql.DB, stmts string) {
+	t.Helper()
+	for _, stmt := range strings.Split(stmts, ";\n") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+// schema returns each table's columns.
+func schema(t *testing.T, db *sql.DB) map[string][]string {
+	t.Helper()
+	rows, err := db.Query("select m.name, p.name || ' ' || p.type from sqlite_master m, pragma_table_info(m.name) p where m.type='table' order by m.name, p.cid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	out := make(map[string][]string)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			t.Fatal(err)
+		}
+		out[table] = append(out[table], column)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	db := openTestDB(t)
+	loadBaselineFixture(t, db)
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	if err := db.QueryRow("pragma user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("got user_version %d, want %d", version, len(migrations))
+	}
+
+	var events []string
+	rows, err := db.Query("select event from outage_events order by outage_id, observed_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e string
+		if err := rows.Scan(&e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]string{"Initial", "Update", "Missing", "Initial"}, events); d != "" {
+		t.Errorf("events mismatch (-want +got):\n%s", d)
+	}
+
+	var points, area string
+	if err := db.QueryRow("select points, area from outages where id=1").Scan(&points, &area); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"MultiPoint","coordinates":[[-63.5,44.6]]}`; points != want {
+		t.Errorf("got points %s, want %s", points, want)
+	}
+	if want := `{"type":"MultiPolygon","coordinates":[[[[-63.5,44.6],[-63.4,44.6],[-63.4,44.7],[-63.5,44.6]]]]}`; area != want {
+		t.Errorf("got area %s, want %s", area, want)
+	}
+
+	var places []string
+	prows, err := db.Query("select outage_id || ' ' || level || ' ' || name from outage_places order by outage_id, level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prows.Close()
+	for prows.Next() {
+		var p string
+		if err := prows.Scan(&p); err != nil {
+			t.Fatal(err)
+		}
+		places = append(places, p)
+	}
+	if err := prows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]string{"1 county Halifax", "1 neighborhood North End", "2 county Halifax"}, places); d != "" {
+		t.Errorf("outage_places mismatch (-want +got):\n%s", d)
+	}
+
+	cur, err := st.currentOutages(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cur) != 1 || cur[2].ID != 2 {
+		t.Fatalf("got current outages %+v, want only outage 2", cur)
+	}
+
+	to := cur[2]
+	to.Events = append(to.Events, trackingEvent{ObservedAt: time.Date(2021, 1, 18, 19, 54, 33, 0, time.UTC), Name: "Update"})
+	if _, err := st.emit(t.Context(), to); err != nil {
+		t.Fatal(err)
+	}
+
+	var observations, masked int
+	var wasCluster bool
+	if err := db.QueryRow("select observations, masked_observations, was_cluster from outage_summaries where id=2").Scan(&observations, &masked, &wasCluster); err != nil {
+		t.Fatal(err)
+	}
+	if observations != 2 || masked != 0 || wasCluster {
+		t.Errorf("got observations %d, masked_observations %d, was_cluster %v, want 2, 0, false", observations, masked, wasCluster)
+	}
+}
+
+func TestMigrateEachVersion(t *testing.T) {
+	fresh := openTestDB(t)
+	if err := migrate(fresh); err != nil {
+		t.Fatal(err)
+	}
+	want := schema(t, fresh)
+
+	// Data that must survive migrating from the version it was
+	// written at.
+	kept := []struct {
+		version int
+		query   string
+		want    string
+	}{
+		{2, "select upstream_id from outages where id=2", "1234"},
+		{2, "select group_concat(event) from (select event from outage_events order by outage_id, observed_at)", "Initial,Update,Missing,Initial"},
+		{4, "select cluster || ' ' || n_out from outage_events where outage_id=2", "1 2"},
+		{4, "select group_concat(cust_aff) from (select cust_aff from outage_cluster_members order by member)", "10,20"},
+		{4, "select was_cluster from outage_summaries where id=2", "1"},
+		{5, "select group_concat(cust_aff_masked) from (select cust_aff_masked from outage_events where outage_id=1 order by observed_at)", "1"},
+		{5, "select masked_observations from outage_summaries where id=1", "1"},
+		{6, "select points from outages where id=2", `{"type":"MultiPoint","coordinates":[[-63.4,44.7],[-63.41,44.71]]}`},
+		{6, "select area_sqm || ' ' || area from outage_events where outage_id=2", `44000000.5 {"type":"MultiPolygon","coordinates":[[[[-63.4,44.7],[-63.3,44.7],[-63.3,44.8],[-63.4,44.7]]]]}`},
+		{7, "select changes from outage_events where outage_id=1 and observed_at='2021-01-18T19:44:33Z'", "CauseChanged,CustomersChanged,ETRChanged"},
+		{7, "select seen_until || ' ' || repeats from outage_events where outage_id=2", "2021-01-18T19:49:33Z 1"},
+		{9, "select group_concat(outage_id) from (select outage_id from outage_events where observation_id=1 order by outage_id)", "1,2"},
+	}
+
+	for v := 0; v <= len(migrations); v++ {
+		db := openTestDB(t)
+		if err := migrateTo(db, v); err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		// The baseline fixture's inserts only use columns every
+		// version has, the versioned fixture fills in the rest.
+		loadBaselineFixture(t, db)
+		loadVersionedFixture(t, db, v)
+
+		if err := migrate(db); err != nil {
+			t.Fatalf("migrating from version %d: %v", v, err)
+		}
+
+		if d := cmp.Diff(want, schema(t, db)); d != "" {
+			t.Errorf("schema migrated from version %d mismatch (-fresh +migrated):\n%s", v, d)
+		}
+
+		var outages int
+		if err := db.QueryRow("select count(*) from outages").Scan(&outages); err != nil {
+			t.Fatal(err)
+		}
+		if outages != 2 {
+			t.Errorf("got %d outages after migrating from version %d, want 2", outages, v)
+		}
+
+		for _, k := range kept {
+			if k.version > v {
+				continue
+			}
+			var got string
+			if err := db.QueryRow(k.query).Scan(&got); err != nil {
+				t.Fatalf("migrated from version %d: %s: %v", v, k.query, err)
+			}
+			if got != k.want {
+				t.Errorf("migrated from version %d: %s: got %s, want %s", v, k.query, got, k.want)
+			}
+		}
+
+		st := &store{db: db}
+		cur, err := st.currentOutages(t.Context())
+		if err != nil {
+			t.Fatalf("current outages migrated from version %d: %v", v, err)
+		}
+		if len(cur) != 1 {
+			t.Errorf("got %d current outages migrated from version %d, want 1", len(cur), v)
+		}
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec("pragma user_version = 1000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err == nil {
+		t.Error("got no error migrating a newer database")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// pipeline ingests snapshots from a source in stages: the source reads
+// each snapshot's data, workers prepare (decode and place) snapshots in
+// parallel, and a single writer records them in the order the source
+// produced them.
+//
+// The source reads data itself since go-git repositories aren't safe
+// for concurrent use.
+type pipeline struct {
+	workers int
+	prepare func(snap snapshot, data []byte) ([]outage, error)
+	record  func(ctx context.Context, snap snapshot, data []byte, outages []outage) error
+}
+
+type pipelineJob struct {
+	snap    snapshot
+	data    []byte
+	outages []outage
+	err     error
+	done    chan struct{} // closed when prepared
+}
+
+// run runs source through the pipeline until it's done. Snapshots
+// prepared before an error or ctx being done are recorded if all
+// snapshots before them were.
+func (p pipeline) run(ctx context.Context, source func(context.Context, func(context.Context, snapshot, io.Reader) error) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	workers := max(p.workers, 1)
+	work := make(chan *pipelineJob)
+	// Bounds how far ahead of the writer the source can get.
+	ordered := make(chan *pipelineJob, 2*workers)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				j.outages, j.err = p.prepare(j.snap, j.data)
+				close(j.done)
+			}
+		}()
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		err := p.write(ctx, ordered)
+		if err != nil {
+			// Stop the source and workers.
+			cancel(err)
+		}
+		written <- err
+	}()
+
+	consume := func(ctx context.Context, s snapshot, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("reading outages: %w", err)
+		}
+
+		j := &pipelineJob{snap: s, data: data, done: make(chan struct{})}
+		select {
+		case ordered <- j:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+		select {
+		case work <- j:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+		return nil
+	}
+
+	err := source(ctx, consume)
+	close(ordered)
+	close(work)
+	wg.Wait()
+
+	// The writer's error is what stopped the source, if it failed.
+	if werr := <-written; werr != nil {
+		return werr
+	}
+	return err
+}
+
+func (p pipeline) write(ctx context.Context, ordered <-chan *pipelineJob) error {
+	for j := range ordered {
+		select {
+		case <-j.done:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+		if j.err != nil {
+			return fmt.Errorf("preparing snapshot %s observed at %v: %w", j.snap.Blob, j.snap.ObservedAt, j.err)
+		}
+		// Stop between snapshots when ctx is done.
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+		if err := p.record(ctx, j.snap, j.data, j.outages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/twpayne/go-polyline"
+)
+
+// testPipelineSource returns a source producing n snapshots whose data
+// is their index.
+func testPipelineSource(n int) func(context.Context, func(context.Context, snapshot, io.Reader) error) error {
+	t0 := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	return func(ctx context.Context, consume func(context.Context, snapshot, io.Reader) error) error {
+		for i := range n {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			s := snapshot{ObservedAt: t0.Add(time.Duration(i) * time.Minute), Blob: strconv.Itoa(i)}
+			if err := consume(ctx, s, strings.NewReader(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	const n = 200
+	var recorded []int
+	p := pipeline{
+		workers: 8,
+		prepare: func(s snapshot, data []byte) ([]outage, error) {
+			// Finish out of order.
+			time.Sleep(time.Duration(rand.IntN(100)) * time.Microsecond)
+			return []outage{{ID: string(data)}}, nil
+		},
+		record: func(_ context.Context, s snapshot, data []byte, outages []outage) error {
+			if string(data) != s.Blob || outages[0].ID != s.Blob {
+				return fmt.Errorf("snapshot %s recorded with data %q and outages %v", s.Blob, data, outages)
+			}
+			i, _ := strconv.Atoi(s.Blob)
+			recorded = append(recorded, i)
+			return nil
+		},
+	}
+
+	if err := p.run(t.Context(), testPipelineSource(n)); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != n {
+		t.Fatalf("got %d recorded, want %d", len(recorded), n)
+	}
+	for i, r := range recorded {
+		if r != i {
+			t.Fatalf("recorded %d at %d, want in order", r, i)
+		}
+	}
+}
+
+func TestPipelineErrors(t *testing.T) {
+	errPrepare := errors.New("prepare failed")
+	errRecord := errors.New("record failed")
+	errSource := errors.New("source failed")
+
+	cases := []struct {
+		name         string
+		failPrepare  int
+		failRecord   int
+		failSource   bool
+		wantErr      error
+		wantRecorded int
+	}{
+		{name: "prepare", failPrepare: 5, wantErr: errPrepare, wantRecorded: 5},
+		{name: "record", failRecord: 5, wantErr: errRecord, wantRecorded: 5},
+		{name: "source", failSource: true, wantErr: errSource, wantRecorded: 10},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var recorded int
+			p := pipeline{
+				workers: 4,
+				prepare: func(s snapshot, data []byte) ([]outage, error) {
+					if tc.failPrepare > 0 && s.Blob == strconv.Itoa(tc.failPrepare) {
+						return nil, errPrepare
+					}
+					return nil, nil
+				},
+				record: func(_ context.Context, s snapshot, _ []byte, _ []outage) error {
+					if tc.failRecord > 0 && s.Blob == strconv.Itoa(tc.failRecord) {
+						return errRecord
+					}
+					recorded++
+					return nil
+				},
+			}
+
+			source := testPipelineSource(10)
+			if tc.failSource {
+				inner := source
+				source = func(ctx context.Context, consume func(context.Context, snapshot, io.Reader) error) error {
+					if err := inner(ctx, consume); err != nil {
+						return err
+					}
+					return errSource
+				}
+			} else {
+				// Keep the source going so it has to be stopped.
+				source = testPipelineSource(1000)
+			}
+
+			err := p.run(t.Context(), source)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+			if recorded != tc.wantRecorded {
+				t.Errorf("got %d recorded, want %d", recorded, tc.wantRecorded)
+			}
+		})
+	}
+}
+
+func TestPipelineCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var recorded int
+	p := pipeline{
+		workers: 4,
+		prepare: func(snapshot, []byte) ([]outage, error) { return nil, nil },
+		record: func(_ context.Context, s snapshot, _ []byte, _ []outage) error {
+			recorded++
+			if recorded == 3 {
+				cancel()
+			}
+			return nil
+		},
+	}
+
+	err := p.run(ctx, testPipelineSource(1000))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	// Recording stops between snapshots.
+	if recorded != 3 {
+		t.Errorf("got %d recorded, want 3", recorded)
+	}
+}
+
+// testPlaces returns an n by n grid of county squares covering lon and
+// lat 0 to 1.
+func testPlaces(n int) *geojson.FeatureCollection {
+	fc := geojson.NewFeatureCollection()
+	size := 1 / float64(n)
+	for x := range n {
+		for y := range n {
+			lon, lat := float64(x)*size, float64(y)*size
+			f := geojson.NewFeature(orb.Polygon{{{lon, lat}, {lon + size, lat}, {lon + size, lat + size}, {lon, lat + size}, {lon, lat}}})
+			f.Properties["wof:name"] = fmt.Sprintf("county %d,%d", x, y)
+			f.Properties["wof:placetype"] = "county"
+			fc.Append(f)
+		}
+	}
+	return fc
+}
+
+// testSnapshots returns n snapshots of outages outages each, at random
+// points within testPlaces.
+func testSnapshots(tb testing.TB, n, outages int) [][]byte {
+	tb.Helper()
+	r := rand.New(rand.NewPCG(1, 2))
+	var snaps [][]byte
+	for range n {
+		// Built by hand since weirdZoneTime can't round trip zero
+		// times.
+		var outs []string
+		for j := range outages {
+			p, err := json.Marshal(string(polyline.EncodeCoords([][]float64{{r.Float64(), r.Float64()}})))
+			if err != nil {
+				tb.Fatal(err)
+			}
+			outs = append(outs, fmt.Sprintf(`{"id":"%d","desc":{"etr":"","start":""},"geom":{"p":[%s]}}`, j, p))
+		}
+		snaps = append(snaps, []byte("["+strings.Join(outs, ",")+"]"))
+	}
+	return snaps
+}
+
+// BenchmarkPipeline decodes and places snapshots of outages at new
+// points, as in a backfill, with increasing numbers of workers.
+func BenchmarkPipeline(b *testing.B) {
+	places := testPlaces(30)
+	snaps := testSnapshots(b, 20, 200)
+
+	source := func(ctx context.Context, consume func(context.Context, snapshot, io.Reader) error) error {
+		for i, s := range snaps {
+			if err := consume(ctx, snapshot{Blob: strconv.Itoa(i)}, strings.NewReader(string(s))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				pl, err := newPlacer(places, defaultPlaceLevels)
+				if err != nil {
+					b.Fatal(err)
+				}
+				p := pipeline{
+					workers: workers,
+					prepare: func(_ snapshot, data []byte) ([]outage, error) {
+						var outages []outage
+						if err := json.Unmarshal(data, &outages); err != nil {
+							return nil, err
+						}
+						return outages, pl.place(outages)
+					},
+					record: func(context.Context, snapshot, []byte, []outage) error { return nil },
+				}
+				if err := p.run(b.Context(), source); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPipelineGit ingests snapshots committed to an on-disk repo
+// into an on-disk store, as in a backfill, with increasing numbers of
+// workers. Unlike BenchmarkPipeline it includes reading blobs, which
+// the source does serially, and recording, which the writer does.
+func BenchmarkPipelineGit(b *testing.B) {
+	places := testPlaces(30)
+
+	repoDir := b.TempDir()
+	repo, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		b.Fatal(err)
+	}
+	when := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	for i, data := range testSnapshots(b, 20, 200) {
+		if err := os.WriteFile(filepath.Join(repoDir, "outages.json"), data, 0o644); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := wt.Add("outages.json"); err != nil {
+			b.Fatal(err)
+		}
+		sig := &object.Signature{Name: "scraper", When: when.Add(time.Duration(i) * time.Minute)}
+		if _, err := wt.Commit("update", &git.CommitOptions{Author: sig, Committer: sig}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				b.StopTimer()
+				db, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "outages.db"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				st := &store{db: db}
+				if err := st.init(); err != nil {
+					b.Fatal(err)
+				}
+				tracker := newOutageTracker(st, lonLatMatcher{})
+				pl, err := newPlacer(places, defaultPlaceLevels)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := st.savePlaces(b.Context(), pl.records); err != nil {
+					b.Fatal(err)
+				}
+				tracker.placeOverlaps = pl.placeOverlaps
+				b.StartTimer()
+
+				p := pipeline{
+					workers: workers,
+					prepare: func(_ snapshot, data []byte) ([]outage, error) {
+						var outages []outage
+						if err := json.Unmarshal(data, &outages); err != nil {
+							return nil, err
+						}
+						return outages, pl.place(outages)
+					},
+					record: func(ctx context.Context, s snapshot, _ []byte, outages []outage) error {
+						return tracker.observe(ctx, s, outages)
+					},
+				}
+				err = p.run(b.Context(), func(ctx context.Context, consume func(context.Context, snapshot, io.Reader) error) error {
+					return gitSource(ctx, localOpenRepo(repoDir), "outages.json", gitRange{}, ingestState{}, consume)
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
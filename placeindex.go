@@ -0,0 +1,104 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// placeIndexNodeSize is the most children a placeIndex node has.
+const placeIndexNodeSize = 16
+
+// placeIndex is an R-tree over the bounds of a FeatureCollection's
+// features, packed once with the Sort-Tile-Recursive algorithm since
+// places don't change after loading.
+type placeIndex struct {
+	root *placeIndexNode // nil if there are no features
+}
+
+// placeIndexNode is a feature, if children is nil, or a node bounding
+// its children.
+type placeIndexNode struct {
+	bound    orb.Bound
+	children []placeIndexNode
+	feature  int // index in the FeatureCollection's Features
+}
+
+func newPlaceIndex(features []*geojson.Feature) placeIndex {
+	var nodes []placeIndexNode
+	for i, f := range features {
+		if f.Geometry == nil {
+			continue
+		}
+		nodes = append(nodes, placeIndexNode{bound: f.Geometry.Bound(), feature: i})
+	}
+	if len(nodes) == 0 {
+		return placeIndex{}
+	}
+
+	for len(nodes) > 1 {
+		nodes = packPlaceIndexNodes(nodes)
+	}
+	return placeIndex{root: &nodes[0]}
+}
+
+// packPlaceIndexNodes groups nodes into parents of up to
+// placeIndexNodeSize, first into vertical slices by x and then by y
+// within each slice, so each parent covers a small area.
+func packPlaceIndexNodes(nodes []placeIndexNode) []placeIndexNode {
+	parentCount := (len(nodes) + placeIndexNodeSize - 1) / placeIndexNodeSize
+	sliceSize := int(math.Ceil(math.Sqrt(float64(parentCount)))) * placeIndexNodeSize
+
+	slices.SortFunc(nodes, func(a, b placeIndexNode) int {
+		return cmp.Compare(a.bound.Center().X(), b.bound.Center().X())
+	})
+
+	parents := make([]placeIndexNode, 0, parentCount)
+	for s := range slices.Chunk(nodes, sliceSize) {
+		slices.SortFunc(s, func(a, b placeIndexNode) int {
+			return cmp.Compare(a.bound.Center().Y(), b.bound.Center().Y())
+		})
+		for children := range slices.Chunk(s, placeIndexNodeSize) {
+			bound := children[0].bound
+			for _, c := range children[1:] {
+				bound = bound.Union(c.bound)
+			}
+			parents = append(parents, placeIndexNode{bound: bound, children: children})
+		}
+	}
+	return parents
+}
+
+// candidates returns the indexes, in order, of the features whose
+// bounds contain pt.
+func (x placeIndex) candidates(pt orb.Point) []int {
+	return x.overlapping(orb.Bound{Min: pt, Max: pt})
+}
+
+// overlapping returns the indexes, in order, of the features whose
+// bounds intersect b.
+func (x placeIndex) overlapping(b orb.Bound) []int {
+	if x.root == nil {
+		return nil
+	}
+	var found []int
+	x.root.search(b, &found)
+	slices.Sort(found)
+	return found
+}
+
+func (n *placeIndexNode) search(b orb.Bound, found *[]int) {
+	if !n.bound.Intersects(b) {
+		return
+	}
+	if n.children == nil {
+		*found = append(*found, n.feature)
+		return
+	}
+	for i := range n.children {
+		n.children[i].search(b, found)
+	}
+}
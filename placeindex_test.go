@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// linearFeatures is what placer.features did before placeIndex.
+func linearFeatures(places *geojson.FeatureCollection, pt orb.Point) []*geojson.Feature {
+	var feats []*geojson.Feature
+	for _, f := range places.Features {
+		if isPointWithinFeature(pt, f) {
+			feats = append(feats, f)
+		}
+	}
+	return feats
+}
+
+// testOverlappingPlaces returns testPlaces(n) with n*n random
+// overlapping neighbourhoods of various geometry types mixed in.
+func testOverlappingPlaces(n int) *geojson.FeatureCollection {
+	r := rand.New(rand.NewPCG(3, 4))
+	fc := testPlaces(n)
+	for i := range n * n {
+		lon, lat, size := r.Float64(), r.Float64(), r.Float64()/float64(n)
+		var g orb.Geometry
+		switch i % 4 {
+		case 0:
+			g = square(lon, lat, size)[0]
+		case 1:
+			g = append(square(lon, lat, size), square(lon+2*size, lat, size)...)
+		case 2:
+			g = orb.Point{lon, lat}
+		case 3:
+			g = orb.LineString{{lon, lat}, {lon + size, lat + size}}
+		}
+		f := geojson.NewFeature(g)
+		f.Properties["wof:name"] = fmt.Sprintf("neighbourhood %d", i)
+		f.Properties["wof:placetype"] = "neighbourhood"
+		// Interleave them with the counties.
+		fc.Features = append(fc.Features, nil)
+		j := r.IntN(len(fc.Features))
+		copy(fc.Features[j+1:], fc.Features[j:])
+		fc.Features[j] = f
+	}
+	return fc
+}
+
+func TestPlaceIndex(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 40} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			places := testOverlappingPlaces(n)
+			pl, err := newPlacer(places, defaultPlaceLevels)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := rand.New(rand.NewPCG(5, 6))
+			var pts []orb.Point
+			for range 2000 {
+				pts = append(pts, orb.Point{r.Float64()*1.2 - 0.1, r.Float64()*1.2 - 0.1})
+			}
+			// Corners, edges and points shared with features.
+			for i := range n + 1 {
+				pts = append(pts, orb.Point{float64(i) / float64(n), float64(i) / float64(n)}, orb.Point{float64(i) / float64(n), 0.5})
+			}
+			for _, f := range places.Features {
+				if p, ok := f.Geometry.(orb.Point); ok {
+					pts = append(pts, p)
+				}
+			}
+
+			var found int
+			for _, pt := range pts {
+				want := linearFeatures(places, pt)
+				found += len(want)
+				if d := cmp.Diff(want, pl.features(pt)); d != "" {
+					t.Fatalf("features at %v mismatch (-want +got):\n%s", pt, d)
+				}
+			}
+			if n > 0 && found == 0 {
+				t.Fatal("found no features, test is broken")
+			}
+		})
+	}
+}
+
+// BenchmarkPlacer places new points, and overlaps new areas, among a
+// few thousand polygons, as with postal areas.
+func BenchmarkPlacer(b *testing.B) {
+	places := testOverlappingPlaces(40)
+	r := rand.New(rand.NewPCG(7, 8))
+	var pts []orb.Point
+	for range 1000 {
+		pts = append(pts, orb.Point{r.Float64(), r.Float64()})
+	}
+
+	b.Run("linear", func(b *testing.B) {
+		for b.Loop() {
+			for _, pt := range pts {
+				linearFeatures(places, pt)
+			}
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		idx := newPlaceIndex(places.Features)
+		for b.Loop() {
+			for _, pt := range pts {
+				for _, i := range idx.candidates(pt) {
+					isPointWithinFeature(pt, places.Features[i])
+				}
+			}
+		}
+	})
+	b.Run("overlaps", func(b *testing.B) {
+		var areas []orb.MultiPolygon
+		for _, pt := range pts[:100] {
+			areas = append(areas, orb.MultiPolygon{testStar(r, pt, 0.05)})
+		}
+		pl, err := newPlacer(places, defaultPlaceLevels)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for b.Loop() {
+			for _, a := range areas {
+				pl.areaOverlaps(a)
+			}
+		}
+	})
+	b.Run("build", func(b *testing.B) {
+		for b.Loop() {
+			newPlaceIndex(places.Features)
+		}
+	})
+}
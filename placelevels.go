@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+)
+
+// placeLevel is a level of the place hierarchy, such as county or
+// neighbourhood, that outages are placed at.
+type placeLevel struct {
+	// Level names the level in outage_places. Levels named county and
+	// neighborhood also fill the outages columns of those names.
+	Level string `json:"level"`
+	// PlaceType is the value of the TypeProperty (wof:placetype by
+	// default) of features at this level.
+	PlaceType    string `json:"placetype"`
+	TypeProperty string `json:"type_property,omitempty"`
+	// NameProperty is the property naming the place, wof:name by
+	// default.
+	NameProperty string `json:"name_property,omitempty"`
+	// TieBreak picks between several features at this level containing
+	// an outage: first or last in the places file, or smallest or
+	// largest in area. Defaults to first.
+	TieBreak string `json:"tie_break,omitempty"`
+}
+
+// defaultPlaceLevels are the levels used without -place-levels.
+var defaultPlaceLevels = []placeLevel{
+	{Level: "county", PlaceType: "county", TieBreak: "last"},
+	{Level: "neighborhood", PlaceType: "neighbourhood", TieBreak: "smallest"}, // whosonfirst spelling
+}
+
+// loadPlaceLevels reads a JSON array of levels from path, or returns
+// defaultPlaceLevels if path is empty.
+func loadPlaceLevels(path string) ([]placeLevel, error) {
+	if path == "" {
+		return defaultPlaceLevels, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var levels []placeLevel
+	if err := json.Unmarshal(b, &levels); err != nil {
+		return nil, fmt.Errorf("decoding place levels: %w", err)
+	}
+	if err := checkPlaceLevels(levels); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return levels, nil
+}
+
+func checkPlaceLevels(levels []placeLevel) error {
+	seen := make(map[string]bool)
+	for _, l := range levels {
+		if l.Level == "" || l.PlaceType == "" {
+			return fmt.Errorf("place level %+v needs a level and placetype", l)
+		}
+		if seen[l.Level] {
+			return fmt.Errorf("place level %q listed more than once", l.Level)
+		}
+		seen[l.Level] = true
+		switch l.TieBreak {
+		case "", "first", "last", "smallest", "largest":
+		default:
+			return fmt.Errorf("place level %q has unknown tie_break %q, want first, last, smallest or largest", l.Level, l.TieBreak)
+		}
+	}
+	return nil
+}
+
+func (l placeLevel) matches(f *geojson.Feature) bool {
+	prop := l.TypeProperty
+	if prop == "" {
+		prop = "wof:placetype"
+	}
+	return propertyString(f, prop) == l.PlaceType
+}
+
+func (l placeLevel) name(f *geojson.Feature) string {
+	prop := l.NameProperty
+	if prop == "" {
+		prop = "wof:name"
+	}
+	return propertyString(f, prop)
+}
+
+// propertyString returns f's property prop as a string, formatting
+// numbers and booleans, or "" if it's missing or of another type.
+// Properties are user-configurable, so they may not be strings.
+func propertyString(f *geojson.Feature, prop string) string {
+	switch v := f.Properties[prop].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// propertyInt returns f's property prop as an integer, parsing it if
+// it's a string, or 0 if it's missing or not an integer.
+func propertyInt(f *geojson.Feature, prop string) int64 {
+	switch v := f.Properties[prop].(type) {
+	case float64:
+		return int64(v)
+	case int:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// pick returns which of best and f, the later feature, to place an
+// outage in at this level. best is nil if f is the first match.
+func (l placeLevel) pick(best, f *geojson.Feature) *geojson.Feature {
+	if best == nil {
+		return f
+	}
+	switch l.TieBreak {
+	case "last":
+		return f
+	case "smallest":
+		if planar.Area(f.Geometry) < planar.Area(best.Geometry) {
+			return f
+		}
+	case "largest":
+		if planar.Area(f.Geometry) > planar.Area(best.Geometry) {
+			return f
+		}
+	}
+	return best
+}
+
+// outagePlace is the place an outage is in at a level.
+type outagePlace struct {
+	Level   string
+	Name    string
+	PlaceID int64 // see newPlaceRecord
+}
+
+// placeRecord is a place as stored in the places table.
+type placeRecord struct {
+	ID        int64
+	PlaceType string
+	Name      string
+	ParentID  int64 // 0 if none
+	Geometry  orb.Geometry
+}
+
+// newPlaceRecord returns f as a place, typed and named by the first of
+// levels it's at, or by its wof:placetype and wof:name otherwise.
+//
+// Its ID is f's wof:id if it has one. Otherwise it's generated from a
+// hash of its type, name and geometry, so it's stable across runs with
+// the same places file, with bit 62 set so it can't collide with a
+// whosonfirst ID.
+func newPlaceRecord(f *geojson.Feature, levels []placeLevel) (placeRecord, error) {
+	p := placeRecord{
+		ID:        propertyInt(f, "wof:id"),
+		PlaceType: propertyString(f, "wof:placetype"),
+		Name:      propertyString(f, "wof:name"),
+		ParentID:  max(propertyInt(f, "wof:parent_id"), 0), // -1 for none
+		Geometry:  f.Geometry,
+	}
+	for _, l := range levels {
+		if l.matches(f) {
+			p.PlaceType, p.Name = l.PlaceType, l.name(f)
+			break
+		}
+	}
+	if p.ID > 0 {
+		return p, nil
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00", p.PlaceType, p.Name)
+	if f.Geometry != nil {
+		b, err := geojson.NewGeometry(f.Geometry).MarshalJSON()
+		if err != nil {
+			return placeRecord{}, fmt.Errorf("place %q: %w", p.Name, err)
+		}
+		h.Write(b)
+	}
+	p.ID = int64(h.Sum64()>>2 | 1<<62)
+	return p, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/twpayne/go-polyline"
+)
+
+func testPlace(g orb.Geometry, props geojson.Properties) *geojson.Feature {
+	f := geojson.NewFeature(g)
+	f.Properties = props
+	return f
+}
+
+func TestPlacerLevels(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	fc.Append(testPlace(square(0, 0, 4)[0], geojson.Properties{"wof:placetype": "county", "wof:name": "West"}))
+	fc.Append(testPlace(square(0, 0, 8)[0], geojson.Properties{"wof:placetype": "county", "wof:name": "Overlapping"}))
+	fc.Append(testPlace(square(0, 0, 2)[0], geojson.Properties{"wof:placetype": "neighbourhood", "wof:name": "Small"}))
+	fc.Append(testPlace(square(0, 0, 3)[0], geojson.Properties{"wof:placetype": "neighbourhood", "wof:name": "Large"}))
+	fc.Append(testPlace(square(0, 0, 4)[0], geojson.Properties{"kind": "fsa", "CFSAUID": "B3K"}))
+	fc.Append(testPlace(square(0, 0, 4)[0], geojson.Properties{"kind": "fsa"}))
+
+	// At 1,1 inside everything, at 3.5,3.5 outside the neighbourhoods
+	// and at 6,6 only in the overlapping county.
+	var outages []outage
+	for _, c := range []float64{1, 3.5, 6} {
+		outages = append(outages, outage{Geom: outageGeom{P: []string{string(polyline.EncodeCoords([][]float64{{c, c}}))}}})
+	}
+	outages = append(outages, outage{ID: "no points"})
+
+	cases := []struct {
+		name   string
+		levels []placeLevel
+		want   [][]outagePlace
+	}{
+		{
+			name:   "default",
+			levels: defaultPlaceLevels,
+			want: [][]outagePlace{
+				{{Level: "county", Name: "Overlapping"}, {Level: "neighborhood", Name: "Small"}},
+				{{Level: "county", Name: "Overlapping"}},
+				{{Level: "county", Name: "Overlapping"}},
+				nil,
+			},
+		},
+		{
+			name: "configured",
+			levels: []placeLevel{
+				{Level: "region", PlaceType: "county", TieBreak: "largest"},
+				{Level: "county", PlaceType: "county"},
+				{Level: "locality", PlaceType: "neighbourhood", TieBreak: "last"},
+				{Level: "fsa", PlaceType: "fsa", TypeProperty: "kind", NameProperty: "CFSAUID"},
+			},
+			want: [][]outagePlace{
+				{{Level: "region", Name: "Overlapping"}, {Level: "county", Name: "West"}, {Level: "locality", Name: "Large"}, {Level: "fsa", Name: "B3K"}},
+				{{Level: "region", Name: "Overlapping"}, {Level: "county", Name: "West"}, {Level: "fsa", Name: "B3K"}},
+				{{Level: "region", Name: "Overlapping"}, {Level: "county", Name: "Overlapping"}},
+				nil,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			outs := append([]outage(nil), outages...)
+			pl, err := newPlacer(fc, tc.levels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pl.place(outs); err != nil {
+				t.Fatal(err)
+			}
+			ids := make(map[int64]placeRecord)
+			for _, r := range pl.records {
+				ids[r.ID] = r
+			}
+
+			var got [][]outagePlace
+			for _, o := range outs {
+				for i, p := range o.Geom.Places {
+					if r, ok := ids[p.PlaceID]; !ok || r.Name != p.Name {
+						t.Errorf("got place %+v, want the ID of a place named %s", p, p.Name)
+					}
+					o.Geom.Places[i].PlaceID = 0
+				}
+				got = append(got, o.Geom.Places)
+				var county, neighborhood string
+				for _, p := range o.Geom.Places {
+					switch p.Level {
+					case "county":
+						county = p.Name
+					case "neighborhood":
+						neighborhood = p.Name
+					}
+				}
+				if o.Geom.County != county || o.Geom.Neighborhood != neighborhood {
+					t.Errorf("got county %q and neighborhood %q, want %q and %q", o.Geom.County, o.Geom.Neighborhood, county, neighborhood)
+				}
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("places mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestPlacerNumericProperties(t *testing.T) {
+	// As decoded from JSON, with numbers and IDs that aren't strings
+	// and ints.
+	fc := geojson.NewFeatureCollection()
+	fc.Append(testPlace(square(0, 0, 4)[0], geojson.Properties{"admin_level": 6.0, "ref": 902.0, "wof:id": "85632", "wof:placetype": 1.0}))
+	fc.Append(testPlace(square(0, 0, 8)[0], geojson.Properties{"admin_level": "6", "ref": true, "wof:id": 85633.0}))
+
+	levels := append([]placeLevel{{Level: "district", PlaceType: "6", TypeProperty: "admin_level", NameProperty: "ref"}}, defaultPlaceLevels...)
+	pl, err := newPlacer(fc, levels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for _, r := range pl.records {
+		ids = append(ids, r.ID)
+	}
+	if d := cmp.Diff([]int64{85632, 85633}, ids); d != "" {
+		t.Errorf("place IDs mismatch (-want +got):\n%s", d)
+	}
+
+	outs := []outage{{Geom: outageGeom{P: []string{string(polyline.EncodeCoords([][]float64{{1, 1}}))}}}}
+	if err := pl.place(outs); err != nil {
+		t.Fatal(err)
+	}
+	want := []outagePlace{{Level: "district", Name: "902", PlaceID: 85632}}
+	if d := cmp.Diff(want, outs[0].Geom.Places); d != "" {
+		t.Errorf("places mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestLoadPlaceLevels(t *testing.T) {
+	levels, err := loadPlaceLevels("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(defaultPlaceLevels, levels); d != "" {
+		t.Errorf("default levels mismatch (-want +got):\n%s", d)
+	}
+
+	cases := []struct {
+		name    string
+		json    string
+		want    []placeLevel
+		wantErr string
+	}{
+		{
+			name: "ok",
+			json: `[{"level":"county","placetype":"county"},{"level":"fsa","placetype":"fsa","type_property":"kind","name_property":"CFSAUID","tie_break":"smallest"}]`,
+			want: []placeLevel{
+				{Level: "county", PlaceType: "county"},
+				{Level: "fsa", PlaceType: "fsa", TypeProperty: "kind", NameProperty: "CFSAUID", TieBreak: "smallest"},
+			},
+		},
+		{name: "duplicate", json: `[{"level":"county","placetype":"county"},{"level":"county","placetype":"region"}]`, wantErr: "more than once"},
+		{name: "tie break", json: `[{"level":"county","placetype":"county","tie_break":"biggest"}]`, wantErr: "unknown tie_break"},
+		{name: "missing placetype", json: `[{"level":"county"}]`, wantErr: "needs a level and placetype"},
+		{name: "not json", json: `county`, wantErr: "decoding place levels"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "levels.json")
+			if err := os.WriteFile(path, []byte(tc.json), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadPlaceLevels(path)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tc.want, got); d != "" {
+				t.Errorf("levels mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+)
+
+// outagePlaceOverlap is a place an outage's area overlaps at a level.
+type outagePlaceOverlap struct {
+	Level   string
+	Name    string
+	PlaceID int64
+	// Fraction is how much of the outage's area is in the place, 1 for
+	// outages placed by point.
+	Fraction float64
+}
+
+// minOverlapFraction is the smallest overlap recorded, so places that
+// only share an edge with an outage's area don't count.
+const minOverlapFraction = 1e-6
+
+// overlapTriangle is a counter-clockwise triangle that adds to (sign 1)
+// or removes from (sign -1) the polygon it's part of.
+type overlapTriangle struct {
+	pts   [3]orb.Point
+	sign  float64
+	bound orb.Bound
+}
+
+// overlapTriangles returns a fan of signed triangles from the first
+// vertex of each ring of mp, such that a point is inside mp if the
+// signs of the triangles containing it sum to 1. This holds for
+// non-convex rings and holes, so the overlap of two polygons is the sum
+// of the overlaps of each pair of their triangles, which are convex.
+func overlapTriangles(mp orb.MultiPolygon) []overlapTriangle {
+	var tris []overlapTriangle
+	for _, pg := range mp {
+		for r, ring := range pg {
+			ringSign := math.Copysign(1, ringSignedArea(ring))
+			if r > 0 {
+				ringSign = -ringSign // holes
+			}
+			for i := 1; i+1 < len(ring); i++ {
+				t := overlapTriangle{pts: [3]orb.Point{ring[0], ring[i], ring[i+1]}, sign: ringSign}
+				a := triangleSignedArea(t.pts)
+				if a == 0 {
+					continue
+				}
+				if a < 0 {
+					t.pts[1], t.pts[2] = t.pts[2], t.pts[1]
+					t.sign = -t.sign
+				}
+				t.bound = orb.MultiPoint(t.pts[:]).Bound()
+				tris = append(tris, t)
+			}
+		}
+	}
+	return tris
+}
+
+// overlapArea returns the area of the intersection of the polygons the
+// triangles of a and b make up.
+func overlapArea(a, b []overlapTriangle) float64 {
+	var area float64
+	var buf [2][]orb.Point
+	for _, ta := range a {
+		for _, tb := range b {
+			if !ta.bound.Intersects(tb.bound) {
+				continue
+			}
+			clipped := clipToTriangle(ta.pts[:], tb.pts, &buf)
+			area += ta.sign * tb.sign * math.Abs(ringSignedArea(clipped))
+		}
+	}
+	return area
+}
+
+// trianglesArea returns the area of the polygon tris make up.
+func trianglesArea(tris []overlapTriangle) float64 {
+	var area float64
+	for _, t := range tris {
+		area += t.sign * triangleSignedArea(t.pts)
+	}
+	return area
+}
+
+// clipToTriangle returns the part of the convex polygon subject inside
+// the counter-clockwise triangle clip, using the Sutherland–Hodgman
+// algorithm. The result is only valid until the next call with the
+// same buf.
+func clipToTriangle(subject []orb.Point, clip [3]orb.Point, buf *[2][]orb.Point) []orb.Point {
+	out := subject
+	for i := range 3 {
+		if len(out) == 0 {
+			break
+		}
+		a, b := clip[i], clip[(i+1)%3]
+		inside := func(p orb.Point) bool { return cross(a, b, p) >= 0 }
+
+		in := out
+		out = buf[i%2][:0]
+		prev := in[len(in)-1]
+		for _, cur := range in {
+			switch curIn, prevIn := inside(cur), inside(prev); {
+			case curIn && prevIn:
+				out = append(out, cur)
+			case curIn:
+				out = append(out, lineIntersection(prev, cur, a, b), cur)
+			case prevIn:
+				out = append(out, lineIntersection(prev, cur, a, b))
+			}
+			prev = cur
+		}
+		buf[i%2] = out
+	}
+	return out
+}
+
+// lineIntersection returns where the segment from p to q crosses the
+// line through a and b. They must not be parallel.
+func lineIntersection(p, q, a, b orb.Point) orb.Point {
+	cp, cq := cross(a, b, p), cross(a, b, q)
+	t := cp / (cp - cq)
+	return orb.Point{p[0] + t*(q[0]-p[0]), p[1] + t*(q[1]-p[1])}
+}
+
+func triangleSignedArea(t [3]orb.Point) float64 {
+	return cross(t[0], t[1], t[2]) / 2
+}
+
+// ringSignedArea returns the area of ring, positive if it's
+// counter-clockwise. The ring may or may not be closed.
+func ringSignedArea(ring []orb.Point) float64 {
+	var a float64
+	for i := range ring {
+		p, q := ring[i], ring[(i+1)%len(ring)]
+		a += p[0]*q[1] - q[0]*p[1]
+	}
+	return a / 2
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+	"github.com/twpayne/go-polyline"
+)
+
+func TestOverlapArea(t *testing.T) {
+	// Non-convex, with the notch at 1-2,1-2.
+	ell := orb.Polygon{{{0, 0}, {2, 0}, {2, 1}, {1, 1}, {1, 2}, {0, 2}, {0, 0}}}
+	holed := orb.Polygon{
+		{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}},
+		{{1, 1}, {1, 3}, {3, 3}, {3, 1}, {1, 1}},
+	}
+	clockwise := orb.Polygon{{{0, 0}, {0, 2}, {2, 2}, {2, 0}, {0, 0}}}
+	unclosed := orb.Polygon{{{0, 0}, {2, 0}, {2, 2}, {0, 2}}}
+
+	cases := []struct {
+		name string
+		a, b orb.MultiPolygon
+		want float64
+	}{
+		{"same", square(0, 0, 2), square(0, 0, 2), 4},
+		{"quarter", square(0, 0, 2), square(1, 1, 2), 1},
+		{"inside", square(0, 0, 4), square(1, 1, 1), 1},
+		{"disjoint", square(0, 0, 1), square(2, 2, 1), 0},
+		{"sharing an edge", square(0, 0, 1), square(1, 0, 1), 0},
+		{"non-convex notch", orb.MultiPolygon{ell}, square(1, 1, 1), 0},
+		{"non-convex", orb.MultiPolygon{ell}, square(0.5, 0.5, 1), 0.75},
+		{"hole", orb.MultiPolygon{holed}, square(0, 0, 2), 3},
+		{"in hole", orb.MultiPolygon{holed}, square(1.5, 1.5, 1), 0},
+		{"clockwise", orb.MultiPolygon{clockwise}, square(1, 1, 2), 1},
+		{"unclosed", orb.MultiPolygon{unclosed}, square(1, 1, 2), 1},
+		{"multi", append(square(0, 0, 1), square(2, 0, 1)...), square(0.5, 0, 2), 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := overlapTriangles(tc.a), overlapTriangles(tc.b)
+			if got := overlapArea(a, b); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("got overlap %v, want %v", got, tc.want)
+			}
+			if got := overlapArea(b, a); math.Abs(got-tc.want) > 1e-9 {
+				t.Errorf("got reversed overlap %v, want %v", got, tc.want)
+			}
+			if got, want := trianglesArea(a), planar.Area(tc.a); math.Abs(got-want) > 1e-9 {
+				t.Errorf("got area %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// testStar returns a random star-shaped, usually non-convex, polygon
+// around c.
+func testStar(r *rand.Rand, c orb.Point, radius float64) orb.Polygon {
+	var ring orb.Ring
+	n := 3 + r.IntN(20)
+	for i := range n {
+		a := 2 * math.Pi * float64(i) / float64(n)
+		d := radius * (0.2 + 0.8*r.Float64())
+		ring = append(ring, orb.Point{c[0] + d*math.Cos(a), c[1] + d*math.Sin(a)})
+	}
+	return append(orb.Polygon{}, append(ring, ring[0]))
+}
+
+func TestOverlapPartition(t *testing.T) {
+	grid := testPlaces(7)
+	var cells [][]overlapTriangle
+	for _, f := range grid.Features {
+		cells = append(cells, overlapTriangles(orb.MultiPolygon{f.Geometry.(orb.Polygon)}))
+	}
+
+	r := rand.New(rand.NewPCG(9, 10))
+	for range 50 {
+		star := orb.MultiPolygon{testStar(r, orb.Point{0.2 + 0.6*r.Float64(), 0.2 + 0.6*r.Float64()}, 0.2)}
+		tris := overlapTriangles(star)
+		area := trianglesArea(tris)
+		if want := planar.Area(star); math.Abs(area-want) > 1e-9 {
+			t.Fatalf("got area %v, want %v", area, want)
+		}
+		if self := overlapArea(tris, tris); math.Abs(self-area) > 1e-9 {
+			t.Fatalf("got overlap with itself %v, want its area %v", self, area)
+		}
+
+		// The grid covers it, so its overlaps with the cells add up
+		// to its area.
+		var sum float64
+		for _, cell := range cells {
+			o := overlapArea(tris, cell)
+			if o < -1e-12 {
+				t.Fatalf("got negative overlap %v", o)
+			}
+			sum += o
+		}
+		if math.Abs(sum-area) > 1e-9 {
+			t.Fatalf("got overlaps adding to %v, want area %v", sum, area)
+		}
+	}
+}
+
+func TestPlacerOverlaps(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	fc.Append(testPlace(square(0, 0, 2)[0], geojson.Properties{"wof:id": 1.0, "wof:placetype": "county", "wof:name": "West"}))
+	fc.Append(testPlace(square(2, 0, 2), geojson.Properties{"wof:id": 2.0, "wof:placetype": "county", "wof:name": "East"}))
+	fc.Append(testPlace(square(1, 0, 2)[0], geojson.Properties{"wof:id": 3.0, "wof:placetype": "neighbourhood", "wof:name": "Middle"}))
+	fc.Append(testPlace(orb.Point{1.5, 1.5}, geojson.Properties{"wof:id": 4.0, "wof:placetype": "neighbourhood", "wof:name": "Point"}))
+	pl, err := newPlacer(fc, defaultPlaceLevels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := func(coords ...[]float64) string {
+		// polyline wants lat, lon.
+		var latLons [][]float64
+		for _, c := range coords {
+			latLons = append(latLons, []float64{c[1], c[0]})
+		}
+		return string(polyline.EncodeCoords(latLons))
+	}
+	outages := []outage{
+		// Marker in West, area half in each county and half in Middle.
+		{Geom: outageGeom{P: []string{enc([]float64{1.5, 0.5})}, A: []string{enc([]float64{1, 0}, []float64{3, 0}, []float64{3, 1}, []float64{1, 1})}}},
+		// No area.
+		{Geom: outageGeom{P: []string{enc([]float64{0.5, 0.5})}}},
+		// Area outside every place.
+		{Geom: outageGeom{P: []string{enc([]float64{10, 10})}, A: []string{enc([]float64{10, 10}, []float64{11, 10}, []float64{11, 11})}}},
+	}
+	if err := pl.place(outages); err != nil {
+		t.Fatal(err)
+	}
+	for i := range outages {
+		if o := outages[i].Geom.Overlaps; o != nil {
+			t.Fatalf("got overlaps %v from place, want none until placeOverlaps", o)
+		}
+		pl.placeOverlaps(&outages[i].Geom)
+	}
+
+	want := [][]outagePlaceOverlap{
+		{
+			{Level: "county", Name: "West", PlaceID: 1, Fraction: 0.5},
+			{Level: "county", Name: "East", PlaceID: 2, Fraction: 0.5},
+			{Level: "neighborhood", Name: "Middle", PlaceID: 3, Fraction: 1},
+		},
+		{
+			{Level: "county", Name: "West", PlaceID: 1, Fraction: 1},
+		},
+		nil,
+	}
+	var got [][]outagePlaceOverlap
+	for _, o := range outages {
+		got = append(got, o.Geom.Overlaps)
+	}
+	if d := cmp.Diff(want, got, cmpopts.EquateApprox(0, 1e-9)); d != "" {
+		t.Errorf("overlaps mismatch (-want +got):\n%s", d)
+	}
+	if p := outages[0].Geom.Places; !slices.Equal(p, []outagePlace{{Level: "county", Name: "West", PlaceID: 1}, {Level: "neighborhood", Name: "Middle", PlaceID: 3}}) {
+		t.Errorf("got places %v, want West and Middle by the marker", p)
+	}
+}
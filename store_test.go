@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	_ "github.com/ncruces/go-sqlite3/driver"
 	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/twpayne/go-polyline"
 )
 
 func TestStoreCurrentOutages(t *testing.T) {
@@ -22,14 +31,14 @@ func TestStoreCurrentOutages(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ob, err := st.beginObservation()
+	ob, err := st.beginObservation(t.Context(), snapshot{}, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
 
-	id, err := ob.emit(trackedOutage{
+	id, err := ob.emit(t.Context(), trackedOutage{
 		Outage: outage{
 			Desc: outageDesc{
 				Cause: "Damage Causing Partial Power",
@@ -44,7 +53,7 @@ func TestStoreCurrentOutages(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = ob.emit(trackedOutage{
+	_, err = ob.emit(t.Context(), trackedOutage{
 		Outage: outage{
 			Desc: outageDesc{
 				Cause: "Trees On Line",
@@ -59,7 +68,7 @@ func TestStoreCurrentOutages(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = ob.emit(trackedOutage{
+	_, err = ob.emit(t.Context(), trackedOutage{
 		ID: id,
 		Outage: outage{
 			Desc: outageDesc{
@@ -75,11 +84,11 @@ func TestStoreCurrentOutages(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := ob.close(); err != nil {
+	if err := ob.commit(); err != nil {
 		t.Fatal(err)
 	}
 
-	got, err := st.currentOutages()
+	got, err := st.currentOutages(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -114,7 +123,7 @@ func TestStoreCurrentOutagesEmpty(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	got, err := st.currentOutages()
+	got, err := st.currentOutages(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -159,7 +168,7 @@ func TestStoreEmitNew(t *testing.T) {
 		},
 	}
 
-	id, err := st.emit(to)
+	id, err := st.emit(t.Context(), to)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -182,6 +191,274 @@ func TestStoreEmitNew(t *testing.T) {
 	}
 }
 
+func TestStoreEmitPlaces(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.savePlaces(t.Context(), []placeRecord{{ID: 1 << 62, PlaceType: "county", Name: "Halifax"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	places := []outagePlace{{Level: "county", Name: "Halifax", PlaceID: 1 << 62}, {Level: "neighborhood", Name: "North End"}, {Level: "fsa", Name: "B3K"}}
+	to := trackedOutage{
+		Events: []trackingEvent{{ObservedAt: time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC), Name: "Initial"}},
+		Outage: outage{Geom: outageGeom{County: "Halifax", Neighborhood: "North End", Places: places, Overlaps: []outagePlaceOverlap{{Level: "county", Name: "Halifax", PlaceID: 1 << 62, Fraction: 0.25}}}},
+	}
+	id, err := st.emit(t.Context(), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only new outages are placed.
+	to.ID = id
+	to.Outage.Geom.Places = []outagePlace{{Level: "county", Name: "Kings"}}
+	to.Events = append(to.Events, trackingEvent{ObservedAt: time.Date(2021, 1, 18, 19, 44, 33, 0, time.UTC), Name: "Update"})
+	if _, err := st.emit(t.Context(), to); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("select level, name, coalesce(place_id, 0) from outage_places where outage_id=? order by rowid", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []outagePlace
+	for rows.Next() {
+		var p outagePlace
+		if err := rows.Scan(&p.Level, &p.Name, &p.PlaceID); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(places, got); d != "" {
+		t.Errorf("outage_places mismatch (-want +got):\n%s", d)
+	}
+
+	var overlap outagePlaceOverlap
+	if err := db.QueryRow("select level, name, place_id, fraction from outage_place_overlaps where outage_id=?", id).Scan(&overlap.Level, &overlap.Name, &overlap.PlaceID, &overlap.Fraction); err != nil {
+		t.Fatal(err)
+	}
+	if want := (outagePlaceOverlap{Level: "county", Name: "Halifax", PlaceID: 1 << 62, Fraction: 0.25}); overlap != want {
+		t.Errorf("got overlap %+v, want %+v", overlap, want)
+	}
+}
+
+func TestStoreSavePlaces(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	fc := geojson.NewFeatureCollection()
+	fc.Append(testPlace(square(0, 0, 4)[0], geojson.Properties{"wof:id": 101.0, "wof:parent_id": 100.0, "wof:placetype": "county", "wof:name": "Halifax"}))
+	fc.Append(testPlace(orb.Point{1, 2}, geojson.Properties{"wof:placetype": "neighbourhood", "wof:name": "North End", "wof:parent_id": -1.0}))
+
+	type row struct {
+		ID        int64
+		PlaceType string
+		Name      string
+		ParentID  int64
+		Geometry  string
+	}
+	load := func() []row {
+		t.Helper()
+		pl, err := newPlacer(fc, defaultPlaceLevels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := st.savePlaces(t.Context(), pl.records); err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query("select id, placetype, name, coalesce(parent_id, 0), geometry from places order by id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.ID, &r.PlaceType, &r.Name, &r.ParentID, &r.Geometry); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, r)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	got := load()
+	if len(got) != 2 {
+		t.Fatalf("got %d places, want 2", len(got))
+	}
+	generated := got[1].ID
+	if generated < 1<<62 {
+		t.Errorf("got generated ID %d, want at least 1<<62", generated)
+	}
+	want := []row{
+		{101, "county", "Halifax", 100, `{"type":"Polygon","coordinates":[[[0,0],[4,0],[4,4],[0,4],[0,0]]]}`},
+		{generated, "neighbourhood", "North End", 0, `{"type":"Point","coordinates":[1,2]}`},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("places mismatch (-want +got):\n%s", d)
+	}
+
+	// Loading again keeps IDs, updating places with wof:ids. Changing
+	// a place without one gives it a new ID, keeping the old one for
+	// outages placed in it.
+	fc.Features[0].Properties["wof:name"] = "Halifax County"
+	fc.Features[1].Properties["wof:name"] = "South End"
+	got = load()
+	if len(got) != 3 {
+		t.Fatalf("got %d places, want 3", len(got))
+	}
+	if got[0].Name != "Halifax County" {
+		t.Errorf("got name %q for place 101, want Halifax County", got[0].Name)
+	}
+	if got[1].ID == got[2].ID || (got[1].ID != generated && got[2].ID != generated) {
+		t.Errorf("got IDs %d and %d, want %d and a new one", got[1].ID, got[2].ID, generated)
+	}
+}
+
+func TestStoreReplacePlaces(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	placer := func(fc *geojson.FeatureCollection) *placer {
+		t.Helper()
+		pl, err := newPlacer(fc, defaultPlaceLevels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := st.savePlaces(t.Context(), pl.records); err != nil {
+			t.Fatal(err)
+		}
+		return pl
+	}
+
+	before := geojson.NewFeatureCollection()
+	before.Append(testPlace(square(0, 0, 4)[0], geojson.Properties{"wof:placetype": "county", "wof:name": "West"}))
+	before.Append(testPlace(square(0, 0, 2)[0], geojson.Properties{"wof:placetype": "neighbourhood", "wof:name": "Small"}))
+	pl := placer(before)
+
+	var outages []outage
+	for _, c := range []float64{1, 3, 6} {
+		outages = append(outages, outage{Geom: outageGeom{P: []string{string(polyline.EncodeCoords([][]float64{{c, c}}))}}})
+	}
+	if err := pl.place(outages); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range outages {
+		to := trackedOutage{Events: []trackingEvent{{ObservedAt: time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC), Name: "Initial"}}, Outage: o}
+		if _, err := st.emit(t.Context(), to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// West shrinks, changing its generated ID, and East takes over.
+	after := geojson.NewFeatureCollection()
+	after.Append(testPlace(square(0, 0, 2)[0], geojson.Properties{"wof:placetype": "county", "wof:name": "West"}))
+	after.Append(testPlace(square(2, 2, 6)[0], geojson.Properties{"wof:placetype": "county", "wof:name": "East"}))
+	after.Append(testPlace(square(0, 0, 2)[0], geojson.Properties{"wof:placetype": "neighbourhood", "wof:name": "Small"}))
+	pl = placer(after)
+
+	changed, total, err := st.replacePlaces(t.Context(), pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 2 || total != 3 {
+		t.Errorf("got %d of %d outages changed, want 2 of 3", changed, total)
+	}
+
+	type row struct {
+		ID                                 int
+		County, Neighborhood               string
+		SummaryCounty, SummaryNeighborhood string
+		Places                             string
+	}
+	rows, err := db.Query(`
+select o.id, coalesce(o.county, ''), coalesce(o.neighborhood, ''), coalesce(s.county, ''), coalesce(s.neighborhood, ''),
+  coalesce((select group_concat(p.level || '=' || p.name || '=' || pl.name, ',') from outage_places p join places pl on pl.id=p.place_id where p.outage_id=o.id), '')
+from outages o join outage_summaries s using (id) order by o.id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.ID, &r.County, &r.Neighborhood, &r.SummaryCounty, &r.SummaryNeighborhood, &r.Places); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []row{
+		{1, "West", "Small", "West", "Small", "county=West=West,neighborhood=Small=Small"},
+		{2, "East", "", "East", "", "county=East=East"},
+		{3, "East", "", "East", "", "county=East=East"},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("outages mismatch (-want +got):\n%s", d)
+	}
+
+	var westID int64
+	if err := db.QueryRow("select place_id from outage_places where outage_id=1 and level='county'").Scan(&westID); err != nil {
+		t.Fatal(err)
+	}
+	if want := pl.ids[after.Features[0]]; westID != want {
+		t.Errorf("got West place ID %d, want the new one %d", westID, want)
+	}
+
+	var overlaps string
+	if err := db.QueryRow("select group_concat(outage_id || '=' || level || '=' || name || '=' || fraction, ',') from (select * from outage_place_overlaps order by outage_id, level)").Scan(&overlaps); err != nil {
+		t.Fatal(err)
+	}
+	if want := "1=county=West=1.0,1=neighborhood=Small=1.0,2=county=East=1.0,3=county=East=1.0"; overlaps != want {
+		t.Errorf("got overlaps %s, want %s", overlaps, want)
+	}
+
+	changed, total, err = st.replacePlaces(t.Context(), pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 0 || total != 3 {
+		t.Errorf("got %d of %d outages changed replacing again, want 0 of 3", changed, total)
+	}
+}
+
 func TestStoreEmitExisting(t *testing.T) {
 	db, err := sql.Open("sqlite3", "file::memory:")
 	if err != nil {
@@ -217,7 +494,7 @@ func TestStoreEmitExisting(t *testing.T) {
 		},
 	}
 
-	id, err := st.emit(to)
+	id, err := st.emit(t.Context(), to)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -228,7 +505,7 @@ func TestStoreEmitExisting(t *testing.T) {
 		Name:       "Update",
 	})
 
-	id, err = st.emit(to)
+	id, err = st.emit(t.Context(), to)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -254,3 +531,848 @@ func TestStoreEmitExisting(t *testing.T) {
 		t.Errorf("found %d outage_events with outage_id %d in database", to.ID, found)
 	}
 }
+
+func TestStoreRecentlyResolved(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	emitMissing := func(lon float64, resolvedAt time.Time) int {
+		t.Helper()
+		to := trackedOutage{
+			Outage: outage{Geom: outageGeom{Lon: lon, Lat: 44.6}},
+			Events: []trackingEvent{{ObservedAt: now, Name: "Initial"}},
+		}
+		id, err := st.emit(t.Context(), to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to.ID = id
+		to.Events = append(to.Events, trackingEvent{ObservedAt: resolvedAt, Name: "Missing"})
+		if _, err := st.emit(t.Context(), to); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	emitMissing(-63.5, now.Add(time.Minute))
+	recent := emitMissing(-63.4, now.Add(time.Hour))
+
+	got, err := st.recentlyResolved(t.Context(), now.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d recently resolved outages, want 1", len(got))
+	}
+	if to := got[recent]; to.Outage.Geom.Lon != -63.4 || !to.Events[0].ObservedAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("got recently resolved outage %+v, want outage %d resolved at %v", to, recent, now.Add(time.Hour))
+	}
+}
+
+func TestStoreEmitCluster(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	to := trackedOutage{
+		Events: []trackingEvent{{ObservedAt: now, Name: "Initial"}},
+		Outage: outage{
+			Desc: outageDesc{
+				Cluster: true,
+				NOut:    2,
+				CustA:   outageDescCustA{Val: 7},
+				Outages: []outageDesc{
+					{Cause: "Trees On Line", CustA: outageDescCustA{Val: 3}},
+					{Cause: "Under Investigation", CustA: outageDescCustA{Val: 4}},
+				},
+			},
+		},
+	}
+
+	id, err := st.emit(t.Context(), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to.ID = id
+	to.Outage.Desc = outageDesc{Cause: "Trees On Line", CustA: outageDescCustA{Val: 3}}
+	to.Events = append(to.Events, trackingEvent{ObservedAt: now.Add(time.Minute), Name: "Update"})
+	if _, err := st.emit(t.Context(), to); err != nil {
+		t.Fatal(err)
+	}
+
+	var members, custAff int
+	if err := db.QueryRow("select count(*), sum(cust_aff) from outage_cluster_members where outage_id=?", id).Scan(&members, &custAff); err != nil {
+		t.Fatal(err)
+	}
+	if members != 2 || custAff != 7 {
+		t.Errorf("got %d cluster members with %d customers affected, want 2 with 7", members, custAff)
+	}
+
+	var wasCluster bool
+	if err := db.QueryRow("select was_cluster from outage_summaries where id=?", id).Scan(&wasCluster); err != nil {
+		t.Fatal(err)
+	}
+	if !wasCluster {
+		t.Error("got was_cluster false, want true")
+	}
+}
+
+func TestStoreEmitMasked(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	to := trackedOutage{
+		Events: []trackingEvent{{ObservedAt: now, Name: "Initial"}},
+		Outage: outage{Desc: outageDesc{CustA: outageDescCustA{Masked: true, Val: 1}}},
+	}
+
+	id, err := st.emit(t.Context(), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.ID = id
+
+	for i, val := range []int{12, 30} {
+		to.Outage.Desc.CustA = outageDescCustA{Val: val}
+		to.Events = append(to.Events, trackingEvent{ObservedAt: now.Add(time.Duration(i+1) * time.Minute), Name: "Update"})
+		if _, err := st.emit(t.Context(), to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var minCustAff, maxCustAff, masked int
+	if err := db.QueryRow("select min_cust_aff, max_cust_aff, masked_observations from outage_summaries where id=?", id).Scan(&minCustAff, &maxCustAff, &masked); err != nil {
+		t.Fatal(err)
+	}
+	if minCustAff != 12 || maxCustAff != 30 || masked != 1 {
+		t.Errorf("got min_cust_aff %d, max_cust_aff %d, masked_observations %d, want 12, 30, 1", minCustAff, maxCustAff, masked)
+	}
+}
+
+func TestStoreEmitArea(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	geom := outageGeom{
+		P: []string{"wchyGv|vmJ", "_ibyGn~vmJ"},
+		A: []string{
+			string(polyline.EncodeCoords([][]float64{{44.6, -63.5}, {44.6, -63.4}, {44.7, -63.4}})),
+			string(polyline.EncodeCoords([][]float64{{44.8, -63.5}, {44.8, -63.4}, {44.9, -63.4}})),
+		},
+	}
+	if err := geom.decode(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	to := trackedOutage{
+		Events: []trackingEvent{{ObservedAt: now, Name: "Initial"}},
+		Outage: outage{Geom: geom},
+	}
+
+	id, err := st.emit(t.Context(), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.ID = id
+
+	to.Events = append(to.Events, trackingEvent{ObservedAt: now.Add(time.Minute), Name: "Update"})
+	if _, err := st.emit(t.Context(), to); err != nil {
+		t.Fatal(err)
+	}
+
+	grown := geom
+	grown.Area = orb.MultiPolygon{{{{-63.5, 44.6}, {-63.3, 44.6}, {-63.3, 44.8}, {-63.5, 44.6}}}}
+	to.Outage.Geom = grown
+	to.Events = append(to.Events, trackingEvent{ObservedAt: now.Add(2 * time.Minute), Name: "Update", Changes: []string{"AreaChanged"}})
+	if _, err := st.emit(t.Context(), to); err != nil {
+		t.Fatal(err)
+	}
+
+	var points, area string
+	if err := db.QueryRow("select points, area from outages where id=?", id).Scan(&points, &area); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"MultiPoint","coordinates":[[-60.08796,46.24972],[-60.08824,46.21984]]}`; points != want {
+		t.Errorf("got points %s, want %s", points, want)
+	}
+	if g, err := geojson.UnmarshalGeometry([]byte(area)); err != nil {
+		t.Error(err)
+	} else if !orb.Equal(g.Geometry(), geom.Area) || len(geom.Area) != 2 {
+		t.Errorf("got area %s, want both polygons of %v", area, geom.Area)
+	}
+
+	var areas, areaSqms int
+	if err := db.QueryRow("select count(area), count(area_sqm) from outage_events where outage_id=?", id).Scan(&areas, &areaSqms); err != nil {
+		t.Fatal(err)
+	}
+	if areas != 2 || areaSqms != 3 {
+		t.Errorf("got %d events with area and %d with area_sqm, want 2 and 3", areas, areaSqms)
+	}
+
+	got, err := st.currentOutages(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !orb.Equal(got[id].Outage.Geom.Area, grown.Area) {
+		t.Errorf("got current area %v, want %v", got[id].Outage.Geom.Area, grown.Area)
+	}
+}
+
+func TestStoreExtend(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ob, err := st.beginObservation(t.Context(), snapshot{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	to := trackedOutage{
+		Events: []trackingEvent{{ObservedAt: now, Name: "Initial"}},
+		Outage: outage{Desc: outageDesc{Cause: "Trees On Line", CustA: outageDescCustA{Val: 3, Masked: true}}},
+	}
+
+	id, err := ob.emit(t.Context(), to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.ID = id
+
+	for i := 1; i <= 2; i++ {
+		to.Events = append(to.Events, trackingEvent{ObservedAt: now.Add(time.Duration(i) * time.Minute), Name: "Update", Changes: []string{"Unchanged"}})
+		if err := ob.extend(t.Context(), to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ob.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var events, observations, masked int
+	var lastObserved time.Time
+	if err := db.QueryRow("select count(*), observations, masked_observations, last_observed from outage_events, outage_summaries where outage_id=id and id=?", id).Scan(&events, &observations, &masked, newTimeScanner(&lastObserved)); err != nil {
+		t.Fatal(err)
+	}
+	if events != 1 || observations != 3 || masked != 3 || !lastObserved.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("got %d events, %d observations, %d masked, last observed %v, want 1, 3, 3, %v", events, observations, masked, lastObserved, now.Add(2*time.Minute))
+	}
+
+	got, err := st.currentOutages(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at := got[id].Events[0].ObservedAt; !at.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("got current outage last observed at %v, want %v", at, now.Add(2*time.Minute))
+	}
+}
+
+// BenchmarkStoreEmit measures emitting an update to an existing outage
+// in databases of increasing size, which should take about the same
+// time regardless of size.
+func BenchmarkStoreEmit(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("outages=%d", n), func(b *testing.B) {
+			db, err := sql.Open("sqlite3", "file::memory:")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			db.SetMaxOpenConns(1)
+
+			st := &store{db: db}
+			if err := st.init(); err != nil {
+				b.Fatal(err)
+			}
+
+			now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+			newOutage := func(i int) trackedOutage {
+				return trackedOutage{
+					Events: []trackingEvent{{ObservedAt: now, Name: "Initial"}},
+					Outage: outage{Desc: outageDesc{Cause: "Trees On Line", CustA: outageDescCustA{Val: i % 100}}},
+				}
+			}
+
+			ob, err := st.beginObservation(b.Context(), snapshot{}, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := range n {
+				if _, err := ob.emit(b.Context(), newOutage(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := ob.commit(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				to := newOutage(i)
+				to.ID = i%n + 1
+				to.Events = append(to.Events, trackingEvent{ObservedAt: now.Add(time.Duration(i+1) * time.Second), Name: "Update"})
+				if _, err := st.emit(b.Context(), to); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreIngestState(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := st.ingestState(t.Context(), "git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != (ingestState{}) {
+		t.Errorf("got ingest state %+v before any observation, want zero", got)
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	for i, commit := range []string{"c1", "c2"} {
+		ob, err := st.beginObservation(t.Context(), snapshot{ObservedAt: now.Add(time.Duration(i) * time.Minute), Source: "git", Commit: commit, Blob: "b" + commit}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ob.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err = st.ingestState(t.Context(), "git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ingestState{Commit: "c2", Blob: "bc2", ObservedAt: now.Add(time.Minute)}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("ingest state mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestStoreObservations(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	snaps := []snapshot{
+		{ObservedAt: now, Source: "git", Commit: "c1", Blob: "b1", Author: "A <a@example.com>", Message: "first\n"},
+		{ObservedAt: now.Add(time.Minute), Source: "git", Commit: "c2", Blob: "b2", Author: "A <a@example.com>", Message: "second\n"},
+	}
+
+	to := trackedOutage{Outage: outage{Desc: outageDesc{Cause: "Trees On Line"}}}
+	for i, snap := range snaps {
+		ob, err := st.beginObservation(t.Context(), snap, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "Initial"
+		if i > 0 {
+			name = "Update"
+		}
+		to.Events = append(to.Events, trackingEvent{ObservedAt: snap.ObservedAt, Name: name})
+		id, err := ob.emit(t.Context(), to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		to.ID = id
+		if err := ob.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := db.Query("select o.commit_hash, o.observed_at, o.author, o.message, o.blob_hash, o.outage_count from outage_events e join observations o on o.id=e.observation_id order by e.observed_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []snapshot
+	for rows.Next() {
+		var s snapshot
+		var count int
+		if err := rows.Scan(&s.Commit, newTimeScanner(&s.ObservedAt), &s.Author, &s.Message, &s.Blob, &count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("got outage count %d for %s, want 1", count, s.Commit)
+		}
+		s.Source = "git"
+		got = append(got, s)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff(snaps, got); d != "" {
+		t.Errorf("event observations mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestStoreRederive(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tr *outageTracker
+	consume := func(ctx context.Context, s snapshot, r io.Reader) error {
+		var outages []outage
+		if err := json.NewDecoder(r).Decode(&outages); err != nil {
+			return err
+		}
+		return tr.observe(ctx, s, outages)
+	}
+
+	a := `{"desc":{"cause":"Trees On Line","etr":"","start":""},"geom":{"lon":1,"lat":1}}`
+	a2 := `{"desc":{"cause":"Under Investigation","etr":"","start":""},"geom":{"lon":1,"lat":1}}`
+	b := `{"desc":{"cause":"Trees On Line","etr":"","start":""},"geom":{"lon":2,"lat":2}}`
+	ingest := []string{"[" + a + "]", "[" + a2 + "," + b + "]", "[" + b + "]", "[" + b + "]"}
+
+	tr = newOutageTracker(st, lonLatMatcher{})
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	for i, outages := range ingest {
+		data := []byte(outages)
+		snap := snapshot{ObservedAt: now.Add(time.Duration(i) * time.Minute), Source: "git", Commit: fmt.Sprint("c", i), Blob: fmt.Sprint("b", i)}
+		if i == 3 {
+			// Same file as the previous snapshot.
+			snap.Blob = "b2"
+		}
+		if err := st.archiveSnapshot(t.Context(), snap.Blob, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := consume(t.Context(), snap, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dump := func() []string {
+		t.Helper()
+		var out []string
+		for _, q := range []string{
+			"select outage_id, observed_at, event, cause, changes, observation_id from outage_events order by 1, 2",
+			"select id, resolved, first_observed, last_observed, observations, last_cause from outage_summaries order by 1",
+			"select id, longitude, latitude from outages order by 1",
+			"select id, commit_hash, blob_hash, outage_count from observations order by 1",
+			"select source, commit_hash from ingest_state",
+		} {
+			rows, err := db.Query(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cols, _ := rows.Columns()
+			for rows.Next() {
+				vals := make([]any, len(cols))
+				ptrs := make([]any, len(cols))
+				for i := range vals {
+					ptrs[i] = &vals[i]
+				}
+				if err := rows.Scan(ptrs...); err != nil {
+					t.Fatal(err)
+				}
+				out = append(out, fmt.Sprintf("%v", vals))
+			}
+			if err := rows.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out
+	}
+
+	want := dump()
+
+	snaps, err := st.archivedObservations(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != len(ingest) {
+		t.Fatalf("got %d archived observations, want %d", len(snaps), len(ingest))
+	}
+
+	if err := st.resetDerived(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	tr = newOutageTracker(st, lonLatMatcher{})
+	if err := tr.loadState(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.known) != 0 {
+		t.Fatalf("got %d known outages after reset, want 0", len(tr.known))
+	}
+	if err := archiveSource(t.Context(), st, snaps, consume); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff(want, dump()); d != "" {
+		t.Errorf("rederived database mismatch (-ingested +rederived):\n%s", d)
+	}
+
+	if _, err := db.Exec("delete from snapshots where blob_hash='b2'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.archivedObservations(t.Context()); err == nil {
+		t.Error("got no error with missing archived snapshots")
+	}
+}
+
+func TestStoreObservationCanceled(t *testing.T) {
+	// Canceling can close a connection, which would lose an
+	// in-memory database.
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "outages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	ob, err := st.beginObservation(ctx, snapshot{ObservedAt: now, Source: "git", Commit: "c1"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := trackedOutage{Events: []trackingEvent{{ObservedAt: now, Name: "Initial"}}}
+	if _, err := ob.emit(ctx, to); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := ob.emit(ctx, to); err == nil {
+		t.Error("got no error emitting after cancel")
+	}
+	if err := ob.commit(); err == nil {
+		t.Error("got no error closing after cancel")
+	}
+
+	for _, table := range []string{"outages", "outage_events", "outage_summaries", "observations", "ingest_state"} {
+		var n int
+		if err := db.QueryRow("select count(*) from " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("got %d rows in %s after canceled observation, want 0", n, table)
+		}
+	}
+}
+
+func TestStoreObservationRollback(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	ob, err := st.beginObservation(t.Context(), snapshot{ObservedAt: now, Source: "git", Commit: "c1"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ob.emit(t.Context(), trackedOutage{Events: []trackingEvent{{ObservedAt: now, Name: "Initial"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"outages", "outage_events", "outage_summaries", "observations", "ingest_state"} {
+		var n int
+		if err := db.QueryRow("select count(*) from " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("got %d rows in %s after rollback, want 0", n, table)
+		}
+	}
+
+	db.Close()
+	ob, err = st.beginObservation(t.Context(), snapshot{ObservedAt: now}, 0)
+	if err == nil || ob != nil {
+		t.Errorf("got observation %v and error %v beginning with a closed database, want an error", ob, err)
+	}
+}
+
+func TestStoreMissingObservation(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newOutageTracker(st, lonLatMatcher{})
+	tr.grace = missingGrace{snapshots: 1}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	observe := func(i int, outages ...outage) {
+		t.Helper()
+		snap := snapshot{ObservedAt: now.Add(time.Duration(i) * time.Minute), Source: "git", Commit: fmt.Sprint("c", i)}
+		if err := tr.observe(t.Context(), snap, outages); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	observe(0, testOutage("a", 1, 1))
+	observe(1)
+
+	// Another observation at the time the outage went missing.
+	ob, err := st.beginObservation(t.Context(), snapshot{ObservedAt: now.Add(time.Minute), Commit: "other"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	observe(2)
+
+	rows, err := db.Query("select e.event, e.observed_at, o.commit_hash from outage_events e join observations o on o.id=e.observation_id order by e.observed_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	type event struct {
+		Name, ObservedAt, Commit string
+	}
+	var got []event
+	for rows.Next() {
+		var e event
+		if err := rows.Scan(&e.Name, &e.ObservedAt, &e.Commit); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []event{
+		{"Initial", "2021-01-18T19:34:33Z", "c0"},
+		{"Missing", "2021-01-18T19:35:33Z", "c1"},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("event observations mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestStoreRestartGrace(t *testing.T) {
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	ingest := [][]outage{
+		{testOutage("a", 1, 1), testOutage("b", 2, 2)},
+		{testOutage("b", 2, 2)},
+		{},
+		{},
+		{},
+	}
+
+	// run ingests, restarting before each observation if restart is
+	// set, and returns the events recorded.
+	run := func(restart bool) []string {
+		db, err := sql.Open("sqlite3", "file::memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.SetMaxOpenConns(1)
+
+		st := &store{db: db}
+		if err := st.init(); err != nil {
+			t.Fatal(err)
+		}
+
+		var tr *outageTracker
+		for i, outages := range ingest {
+			if tr == nil || restart {
+				tr = newOutageTracker(st, lonLatMatcher{})
+				tr.grace = missingGrace{snapshots: 2}
+				if err := tr.loadState(t.Context()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			snap := snapshot{ObservedAt: now.Add(time.Duration(i) * time.Minute), Source: "git", Commit: fmt.Sprint("c", i)}
+			if err := tr.observe(t.Context(), snap, outages); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		rows, err := db.Query("select e.outage_id, e.event, e.observed_at, o.commit_hash from outage_events e join observations o on o.id=e.observation_id order by 1, 3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		var events []string
+		for rows.Next() {
+			var id int
+			var name, at, commit string
+			if err := rows.Scan(&id, &name, &at, &commit); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, fmt.Sprintf("%d %s %s %s", id, name, at, commit))
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+
+	want := []string{
+		"1 Initial 2021-01-18T19:34:33Z c0",
+		"1 Missing 2021-01-18T19:35:33Z c1",
+		"2 Initial 2021-01-18T19:34:33Z c0",
+		"2 Update 2021-01-18T19:35:33Z c1",
+		"2 Missing 2021-01-18T19:36:33Z c2",
+	}
+	for _, restart := range []bool{false, true} {
+		if d := cmp.Diff(want, run(restart)); d != "" {
+			t.Errorf("events mismatch restarting %v (-want +got):\n%s", restart, d)
+		}
+	}
+}
+
+func TestStoreRestartCluster(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	st := &store{db: db}
+	if err := st.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	cluster := testOutage("a", -63.5, 44.6)
+	cluster.Desc = outageDesc{
+		Cluster: true,
+		NOut:    2,
+		Outages: []outageDesc{
+			{Cause: "Trees On Line", CustA: outageDescCustA{Val: 4}, Start: weirdZoneTime{now.Add(-time.Hour)}, ETR: weirdZoneTime{now.Add(time.Hour)}},
+			{Cause: "Under Investigation", CustA: outageDescCustA{Val: 5, Masked: true}, Start: weirdZoneTime{now.Add(-time.Minute)}},
+		},
+	}
+
+	newTracker := func() *outageTracker {
+		t.Helper()
+		tr := newOutageTracker(st, lonLatMatcher{})
+		tr.skipUnchanged = true
+		if err := tr.loadState(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		return tr
+	}
+
+	tr := newTracker()
+	for i := range 3 {
+		if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(time.Duration(i) * time.Minute)}, []outage{cluster}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr = newTracker()
+	if d := cmp.Diff(cluster.Desc.Outages, tr.known[1].Outage.Desc.Outages, cmp.Comparer(func(a, b weirdZoneTime) bool { return a.Equal(b.Time) })); d != "" {
+		t.Errorf("reloaded cluster members mismatch (-want +got):\n%s", d)
+	}
+	if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(3 * time.Minute)}, []outage{cluster}); err != nil {
+		t.Fatal(err)
+	}
+
+	var events, repeats int
+	if err := db.QueryRow("select count(*), sum(coalesce(repeats, 0)) from outage_events").Scan(&events, &repeats); err != nil {
+		t.Fatal(err)
+	}
+	if events != 1 || repeats != 3 {
+		t.Errorf("got %d events repeated %d times, want the Initial event repeated 3 times as Unchanged", events, repeats)
+	}
+}
@@ -0,0 +1,16 @@
+-- An outages.db as written before schema versioning, user_version 0.
+create table if not exists outages (id integer primary key, longitude numeric, latitude numeric, county text, neighborhood text, area_polyline text);
+create table if not exists outage_events (outage_id integer references outages on delete cascade, observed_at datetime, removed bool, cause text, cust_aff int, start datetime, etr datetime, primary key(outage_id, observed_at));
+create table if not exists outage_summaries (id integer primary key references outages on delete cascade, resolved bool, first_observed datetime, last_observed datetime, observations int, min_cust_aff int, max_cust_aff int, min_start datetime, max_etr datetime, last_cause text, longitude numeric, latitude numeric, county text, neighborhood text);
+create index if not exists outage_summaries_unresolved on outage_summaries (id, last_observed) where resolved=0;
+
+insert into outages (id, longitude, latitude, county, neighborhood, area_polyline) values (1, -63.5, 44.6, 'Halifax', 'North End', '_}eoG~iqbK?_pR_pR?');
+insert into outages (id, longitude, latitude, county, neighborhood, area_polyline) values (2, -63.4, 44.7, 'Halifax', NULL, NULL);
+
+insert into outage_events (outage_id, observed_at, removed, cause, cust_aff, start, etr) values (1, '2021-01-18T19:34:33Z', 0, 'Under Investigation', 4, '2021-01-18T19:22:00Z', NULL);
+insert into outage_events (outage_id, observed_at, removed, cause, cust_aff, start, etr) values (1, '2021-01-18T19:44:33Z', 0, 'Trees On Line', 12, '2021-01-18T19:22:00Z', '2021-01-18T23:00:00Z');
+insert into outage_events (outage_id, observed_at, removed, cause, cust_aff, start, etr) values (1, '2021-01-18T19:54:33Z', 1, 'Trees On Line', 12, '2021-01-18T19:22:00Z', '2021-01-18T23:00:00Z');
+insert into outage_events (outage_id, observed_at, removed, cause, cust_aff, start, etr) values (2, '2021-01-18T19:44:33Z', 0, 'Under Investigation', 30, '2021-01-18T19:40:00Z', NULL);
+
+insert into outage_summaries (id, resolved, first_observed, last_observed, observations, min_cust_aff, max_cust_aff, min_start, max_etr, last_cause, longitude, latitude, county, neighborhood) values (1, 1, '2021-01-18T19:34:33Z', '2021-01-18T19:54:33Z', 3, 4, 12, '2021-01-18T19:22:00Z', '2021-01-18T23:00:00Z', 'Trees On Line', -63.5, 44.6, 'Halifax', 'North End');
+insert into outage_summaries (id, resolved, first_observed, last_observed, observations, min_cust_aff, max_cust_aff, min_start, max_etr, last_cause, longitude, latitude, county, neighborhood) values (2, 0, '2021-01-18T19:44:33Z', '2021-01-18T19:44:33Z', 1, 30, 30, '2021-01-18T19:40:00Z', NULL, 'Under Investigation', -63.4, 44.7, 'Halifax', NULL);
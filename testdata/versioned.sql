@@ -0,0 +1,30 @@
+-- Data for the baseline fixture's rows in the columns each schema
+-- version added. A database at some version is loaded with each
+-- section up to it.
+
+-- version 2: upstream outage IDs and event names.
+update outages set upstream_id='1234' where id=2;
+update outage_events set event=case when removed then 'Missing' when outage_id=2 or observed_at='2021-01-18T19:34:33Z' then 'Initial' else 'Update' end;
+
+-- version 4: clusters.
+update outage_events set cluster=1, n_out=2 where outage_id=2;
+insert into outage_cluster_members (outage_id, observed_at, member, cause, cust_aff, start, etr) values (2, '2021-01-18T19:44:33Z', 0, 'Under Investigation', 10, '2021-01-18T19:40:00Z', NULL);
+insert into outage_cluster_members (outage_id, observed_at, member, cause, cust_aff, start, etr) values (2, '2021-01-18T19:44:33Z', 1, 'Under Investigation', 20, '2021-01-18T19:41:00Z', NULL);
+update outage_summaries set was_cluster=1 where id=2;
+
+-- version 5: masked customer counts.
+update outage_events set cust_aff_masked=1 where outage_id=1 and observed_at='2021-01-18T19:34:33Z';
+update outage_cluster_members set cust_aff_masked=0;
+update outage_summaries set masked_observations=1 where id=1;
+
+-- version 6: full outage geometry.
+update outages set points='{"type":"MultiPoint","coordinates":[[-63.4,44.7],[-63.41,44.71]]}', area='{"type":"MultiPolygon","coordinates":[[[[-63.4,44.7],[-63.3,44.7],[-63.3,44.8],[-63.4,44.7]]]]}' where id=2;
+update outage_events set area='{"type":"MultiPolygon","coordinates":[[[[-63.4,44.7],[-63.3,44.7],[-63.3,44.8],[-63.4,44.7]]]]}', area_sqm=44000000.5 where outage_id=2;
+
+-- version 7: change classification and extended events.
+update outage_events set changes='CauseChanged,CustomersChanged,ETRChanged' where outage_id=1 and observed_at='2021-01-18T19:44:33Z';
+update outage_events set seen_until='2021-01-18T19:49:33Z', repeats=1 where outage_id=2;
+
+-- version 9: observation provenance.
+insert into observations (id, observed_at, source, commit_hash, outage_count) values (1, '2021-01-18T19:44:33Z', 'git', 'c1', 2);
+update outage_events set observation_id=1 where observed_at='2021-01-18T19:44:33Z';
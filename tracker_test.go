@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/paulmach/orb"
+)
+
+// memStore is an outageStore that records emitted events in memory.
+type memStore struct {
+	lastID  int
+	events  []memEvent
+	links   []memLink
+	emitted []trackedOutage
+
+	// How many observations have begun, also the last one's ID.
+	observations int
+
+	// failWrite, if set, is the write (emit, extend or link) counting
+	// from 1 in each observation that fails. failCommit fails commits.
+	failWrite  int
+	failCommit bool
+	writes     int
+	// What to roll back to.
+	begun *memStore
+}
+
+var errInjected = errors.New("injected failure")
+
+type memEvent struct {
+	ID   int
+	Name string
+	At   time.Time
+}
+
+type memLink struct {
+	ID, LinkedID int
+	Kind         string
+}
+
+func (m *memStore) lastObservedAt(context.Context) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *memStore) observationsAfter(context.Context, time.Time) ([]snapshot, error) {
+	return nil, nil
+}
+
+func (m *memStore) currentOutages(context.Context) (map[int]trackedOutage, error) {
+	return map[int]trackedOutage{}, nil
+}
+
+func (m *memStore) recentlyResolved(context.Context, time.Time) (map[int]trackedOutage, error) {
+	return map[int]trackedOutage{}, nil
+}
+
+func (m *memStore) beginObservation(context.Context, snapshot, int) (storeObservation, error) {
+	m.writes = 0
+	m.begun = &memStore{lastID: m.lastID, observations: m.observations, events: m.events, links: m.links, emitted: m.emitted}
+	m.observations++
+	return m, nil
+}
+
+func (m *memStore) observationID() int {
+	return m.observations
+}
+
+func (m *memStore) write() error {
+	m.writes++
+	if m.writes == m.failWrite {
+		return errInjected
+	}
+	return nil
+}
+
+func (m *memStore) emit(_ context.Context, to trackedOutage) (int, error) {
+	if err := m.write(); err != nil {
+		return 0, err
+	}
+	if to.ID == 0 {
+		m.lastID++
+		to.ID = m.lastID
+	}
+	le := to.Events[len(to.Events)-1]
+	m.events = append(m.events, memEvent{ID: to.ID, Name: le.Name, At: le.ObservedAt})
+	m.emitted = append(m.emitted, to)
+	return to.ID, nil
+}
+
+// extend records an "Extend" event.
+func (m *memStore) extend(_ context.Context, to trackedOutage) error {
+	if err := m.write(); err != nil {
+		return err
+	}
+	le := to.Events[len(to.Events)-1]
+	m.events = append(m.events, memEvent{ID: to.ID, Name: "Extend", At: le.ObservedAt})
+	return nil
+}
+
+func (m *memStore) link(_ context.Context, id, linkedID int, kind string) error {
+	if err := m.write(); err != nil {
+		return err
+	}
+	m.links = append(m.links, memLink{id, linkedID, kind})
+	return nil
+}
+
+func (m *memStore) commit() error {
+	if m.failCommit {
+		m.rollback()
+		return errInjected
+	}
+	return nil
+}
+
+func (m *memStore) rollback() error {
+	b := m.begun
+	m.lastID, m.observations, m.events, m.links, m.emitted = b.lastID, b.observations, b.events, b.links, b.emitted
+	return nil
+}
+
+var ignoreAt = cmpopts.IgnoreFields(memEvent{}, "At")
+
+func testOutage(id string, lon, lat float64) outage {
+	return outage{ID: id, Geom: outageGeom{Lon: lon, Lat: lat}}
+}
+
+func square(lon, lat, size float64) orb.MultiPolygon {
+	return orb.MultiPolygon{{{{lon, lat}, {lon + size, lat}, {lon + size, lat + size}, {lon, lat + size}, {lon, lat}}}}
+}
+
+func TestTrackerMatchers(t *testing.T) {
+	areaOutage := func(lon, lat float64) outage {
+		o := testOutage("", lon, lat)
+		o.Geom.Area = square(lon-0.01, lat-0.01, 0.02)
+		return o
+	}
+
+	continued := []memEvent{{ID: 1, Name: "Initial"}, {ID: 1, Name: "Update"}}
+	replaced := []memEvent{{ID: 1, Name: "Initial"}, {ID: 2, Name: "Initial"}, {ID: 1, Name: "Missing"}}
+
+	cases := []struct {
+		name    string
+		matcher outageMatcher
+		first   outage
+		second  outage
+		want    []memEvent
+	}{
+		{"lonlat same", lonLatMatcher{}, testOutage("a", -63.5, 44.6), testOutage("b", -63.5, 44.6), continued},
+		{"lonlat shifted", lonLatMatcher{}, testOutage("a", -63.5, 44.6), testOutage("a", -63.50001, 44.6), replaced},
+		{"id same", idMatcher{}, testOutage("a", -63.5, 44.6), testOutage("a", -63.4, 44.7), continued},
+		{"id different", idMatcher{}, testOutage("a", -63.5, 44.6), testOutage("b", -63.5, 44.6), replaced},
+		{"id missing falls back to lonlat", idMatcher{}, testOutage("", -63.5, 44.6), testOutage("", -63.5, 44.6), continued},
+		{"distance near", distanceMatcher{maxMeters: 50}, testOutage("a", -63.5, 44.6), testOutage("b", -63.50005, 44.60002), continued},
+		{"distance far", distanceMatcher{maxMeters: 50}, testOutage("a", -63.5, 44.6), testOutage("a", -63.51, 44.6), replaced},
+		{"area overlapping", areaMatcher{}, areaOutage(-63.5, 44.6), areaOutage(-63.49, 44.61), continued},
+		{"area disjoint", areaMatcher{}, areaOutage(-63.5, 44.6), areaOutage(-63.4, 44.6), replaced},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := &memStore{}
+			tr := newOutageTracker(st, tc.matcher)
+
+			now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+			if err := tr.observe(t.Context(), snapshot{ObservedAt: now}, []outage{tc.first}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(time.Minute)}, []outage{tc.second}); err != nil {
+				t.Fatal(err)
+			}
+
+			if d := cmp.Diff(tc.want, st.events, ignoreAt); d != "" {
+				t.Errorf("events mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestTrackerMatchNearest(t *testing.T) {
+	st := &memStore{}
+	tr := newOutageTracker(st, distanceMatcher{maxMeters: 500})
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	if err := tr.observe(t.Context(), snapshot{ObservedAt: now}, []outage{testOutage("", -63.5, 44.6), testOutage("", -63.501, 44.6)}); err != nil {
+		t.Fatal(err)
+	}
+	// Closer to the second outage, but within range of both.
+	if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(time.Minute)}, []outage{testOutage("", -63.5009, 44.6)}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []memEvent{{ID: 1, Name: "Initial"}, {ID: 2, Name: "Initial"}, {ID: 2, Name: "Update"}, {ID: 1, Name: "Missing"}}
+	if d := cmp.Diff(want, st.events, ignoreAt); d != "" {
+		t.Errorf("events mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestTrackerMatchSamePoint(t *testing.T) {
+	for _, m := range []outageMatcher{lonLatMatcher{}, idMatcher{}} {
+		t.Run(fmt.Sprintf("%T", m), func(t *testing.T) {
+			st := &memStore{}
+			tr := newOutageTracker(st, m)
+
+			now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+			same := []outage{testOutage("", -63.5, 44.6), testOutage("", -63.5, 44.6)}
+			if err := tr.observe(t.Context(), snapshot{ObservedAt: now}, same); err != nil {
+				t.Fatal(err)
+			}
+			// Each matches one of the known outages at the point,
+			// lowest ID first.
+			if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(time.Minute)}, same); err != nil {
+				t.Fatal(err)
+			}
+			if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(2 * time.Minute)}, same[:1]); err != nil {
+				t.Fatal(err)
+			}
+
+			want := []memEvent{
+				{ID: 1, Name: "Initial"}, {ID: 2, Name: "Initial"},
+				{ID: 1, Name: "Update"}, {ID: 2, Name: "Update"},
+				{ID: 1, Name: "Update"}, {ID: 2, Name: "Missing"},
+			}
+			if d := cmp.Diff(want, st.events, ignoreAt); d != "" {
+				t.Errorf("events mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestTrackerPlaceOverlaps(t *testing.T) {
+	st := &memStore{}
+	tr := newOutageTracker(st, lonLatMatcher{})
+	var placed int
+	tr.placeOverlaps = func(g *outageGeom) {
+		placed++
+		g.Overlaps = []outagePlaceOverlap{{Level: "county", Name: "Halifax", Fraction: 1}}
+	}
+
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	if err := tr.observe(t.Context(), snapshot{ObservedAt: now}, []outage{testOutage("", -63.5, 44.6)}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the new outage is placed.
+	if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(time.Minute)}, []outage{testOutage("", -63.5, 44.6), testOutage("", -63.6, 44.6)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if placed != 2 {
+		t.Errorf("placed overlaps %d times, want 2", placed)
+	}
+	var got []int
+	for _, to := range st.emitted {
+		got = append(got, len(to.Outage.Geom.Overlaps))
+	}
+	if want := []int{1, 0, 1}; !slices.Equal(got, want) {
+		t.Errorf("got emitted overlap counts %v, want %v", got, want)
+	}
+}
+
+func TestTrackerMissingGrace(t *testing.T) {
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	at := func(m int) time.Time { return now.Add(time.Duration(m) * time.Minute) }
+	a := testOutage("", -63.5, 44.6)
+
+	cases := []struct {
+		name      string
+		grace     missingGrace
+		snapshots [][]outage
+		want      []memEvent
+	}{
+		{
+			name:      "no grace",
+			snapshots: [][]outage{{a}, {}, {a}},
+			want:      []memEvent{{1, "Initial", at(0)}, {1, "Missing", at(1)}, {2, "Initial", at(2)}},
+		},
+		{
+			name:      "reappears within snapshots",
+			grace:     missingGrace{snapshots: 2},
+			snapshots: [][]outage{{a}, {}, {}, {a}},
+			want:      []memEvent{{1, "Initial", at(0)}, {1, "Reappeared", at(3)}},
+		},
+		{
+			name:      "missing after snapshots",
+			grace:     missingGrace{snapshots: 1},
+			snapshots: [][]outage{{a}, {}, {}, {a}},
+			want:      []memEvent{{1, "Initial", at(0)}, {1, "Missing", at(1)}, {2, "Initial", at(3)}},
+		},
+		{
+			name:      "reappears within duration",
+			grace:     missingGrace{duration: 2 * time.Minute},
+			snapshots: [][]outage{{a}, {}, {}, {a}, {a}},
+			want:      []memEvent{{1, "Initial", at(0)}, {1, "Reappeared", at(3)}, {1, "Update", at(4)}},
+		},
+		{
+			name:      "missing after duration",
+			grace:     missingGrace{duration: 90 * time.Second},
+			snapshots: [][]outage{{a}, {}, {}, {a}},
+			want:      []memEvent{{1, "Initial", at(0)}, {1, "Missing", at(1)}, {2, "Initial", at(3)}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := &memStore{}
+			tr := newOutageTracker(st, lonLatMatcher{})
+			tr.grace = tc.grace
+
+			for i, outages := range tc.snapshots {
+				if err := tr.observe(t.Context(), snapshot{ObservedAt: at(i)}, outages); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if d := cmp.Diff(tc.want, st.events); d != "" {
+				t.Errorf("events mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestTrackerRecurrence(t *testing.T) {
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+	a := testOutage("", -63.5, 44.6)
+	b := testOutage("", -63.4, 44.6)
+
+	cases := []struct {
+		name      string
+		matcher   outageMatcher
+		window    time.Duration
+		snapshots map[time.Duration][]outage
+		want      []memLink
+	}{
+		{
+			name:   "within window",
+			window: time.Hour,
+			snapshots: map[time.Duration][]outage{
+				0:                {a},
+				time.Minute:      {},
+				30 * time.Minute: {a, b},
+			},
+			want: []memLink{{2, 1, "recurrence"}},
+		},
+		{
+			name:   "repeated",
+			window: time.Hour,
+			snapshots: map[time.Duration][]outage{
+				0:                {a},
+				time.Minute:      {},
+				30 * time.Minute: {a},
+				31 * time.Minute: {},
+				40 * time.Minute: {a},
+			},
+			want: []memLink{{2, 1, "recurrence"}, {3, 2, "recurrence"}},
+		},
+		{
+			name:   "outside window",
+			window: time.Hour,
+			snapshots: map[time.Duration][]outage{
+				0:             {a},
+				time.Minute:   {},
+				2 * time.Hour: {a},
+			},
+		},
+		{
+			name:    "new upstream ID",
+			matcher: idMatcher{},
+			window:  time.Hour,
+			snapshots: map[time.Duration][]outage{
+				0:                {testOutage("1", -63.5, 44.6)},
+				time.Minute:      {},
+				30 * time.Minute: {testOutage("2", -63.5, 44.6), testOutage("3", -63.4, 44.6)},
+			},
+			want: []memLink{{2, 1, "recurrence"}},
+		},
+		{
+			name:    "nearby",
+			matcher: distanceMatcher{maxMeters: 100},
+			window:  time.Hour,
+			snapshots: map[time.Duration][]outage{
+				0:                {a},
+				time.Minute:      {},
+				30 * time.Minute: {testOutage("", -63.5005, 44.6)},
+			},
+			want: []memLink{{2, 1, "recurrence"}},
+		},
+		{
+			name: "disabled",
+			snapshots: map[time.Duration][]outage{
+				0:           {a},
+				time.Minute: {},
+				time.Hour:   {a},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			matcher := tc.matcher
+			if matcher == nil {
+				matcher = lonLatMatcher{}
+			}
+			st := &memStore{}
+			tr := newOutageTracker(st, matcher)
+			tr.recurrenceWindow = tc.window
+
+			for _, d := range slices.Sorted(maps.Keys(tc.snapshots)) {
+				if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(d)}, tc.snapshots[d]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if d := cmp.Diff(tc.want, st.links); d != "" {
+				t.Errorf("links mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestTrackerClassifyChanges(t *testing.T) {
+	now := time.Date(2021, 1, 18, 19, 34, 33, 0, time.UTC)
+
+	base := testOutage("", -63.5, 44.6)
+	base.Desc = outageDesc{
+		Cause: "Under Investigation",
+		CustA: outageDescCustA{Val: 4},
+		ETR:   weirdZoneTime{now.Add(time.Hour)},
+	}
+
+	changed := base
+	changed.Desc.Cause = "Trees On Line"
+	changed.Desc.ETR = weirdZoneTime{now.Add(2 * time.Hour)}
+
+	grown := changed
+	grown.Desc.CustA.Val = 40
+	grown.Geom.Area = square(-63.51, 44.59, 0.02)
+
+	cases := []struct {
+		name          string
+		skipUnchanged bool
+		wantEvents    []memEvent
+		wantChanges   [][]string
+	}{
+		{
+			name:        "all",
+			wantEvents:  []memEvent{{ID: 1, Name: "Initial"}, {ID: 1, Name: "Update"}, {ID: 1, Name: "Update"}, {ID: 1, Name: "Update"}},
+			wantChanges: [][]string{nil, {"Unchanged"}, {"ETRChanged", "CauseChanged"}, {"CustomersChanged", "AreaChanged"}},
+		},
+		{
+			name:          "skip unchanged",
+			skipUnchanged: true,
+			wantEvents:    []memEvent{{ID: 1, Name: "Initial"}, {ID: 1, Name: "Extend"}, {ID: 1, Name: "Update"}, {ID: 1, Name: "Update"}},
+			wantChanges:   [][]string{nil, {"ETRChanged", "CauseChanged"}, {"CustomersChanged", "AreaChanged"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := &memStore{}
+			tr := newOutageTracker(st, lonLatMatcher{})
+			tr.skipUnchanged = tc.skipUnchanged
+
+			for i, out := range []outage{base, base, changed, grown} {
+				if err := tr.observe(t.Context(), snapshot{ObservedAt: now.Add(time.Duration(i) * time.Minute)}, []outage{out}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if d := cmp.Diff(tc.wantEvents, st.events, ignoreAt); d != "" {
+				t.Errorf("events mismatch (-want +got):\n%s", d)
+			}
+
+			var gotChanges [][]string
+			for _, to := range st.emitted {
+				gotChanges = append(gotChanges, to.Events[len(to.Events)-1].Changes)
+			}
+			if d := cmp.Diff(tc.wantChanges, gotChanges); d != "" {
+				t.Errorf("changes mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestTrackerObserveFailure(t *testing.T) {
+	now := time.Date(2021, 1, 18, 19, 34, 0, 0, time.UTC)
+	a, b, c, d := testOutage("", 1, 1), testOutage("", 2, 2), testOutage("", 3, 3), testOutage("", 4, 4)
+	a2 := a
+	a2.Desc.Cause = "Trees On Line"
+	snapshots := [][]outage{
+		{a, b, d},
+		// a updated, c new, b and d held.
+		{a2, c},
+		// a and c extended, b reappeared, d missing.
+		{a2, b, c},
+		// d recurs.
+		{a2, b, c, d},
+	}
+
+	newTracker := func(st *memStore) *outageTracker {
+		tr := newOutageTracker(st, lonLatMatcher{})
+		tr.grace = missingGrace{snapshots: 1}
+		tr.recurrenceWindow = time.Hour
+		tr.skipUnchanged = true
+		return tr
+	}
+
+	clean := &memStore{}
+	cleanTr := newTracker(clean)
+	for i, outages := range snapshots {
+		if err := cleanTr.observe(t.Context(), snapshot{ObservedAt: now.Add(time.Duration(i) * time.Minute)}, outages); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st := &memStore{}
+	tr := newTracker(st)
+	allow := cmp.AllowUnexported(trackedOutage{})
+	var failures int
+	for i, outages := range snapshots {
+		snap := snapshot{ObservedAt: now.Add(time.Duration(i) * time.Minute)}
+		// Fail the commit, then each write in turn until there are
+		// no more to fail and the observation succeeds.
+		st.failCommit = true
+		for fail := 0; ; fail++ {
+			known, resolved := maps.Clone(tr.known), maps.Clone(tr.resolved)
+			events, links := slices.Clone(st.events), slices.Clone(st.links)
+
+			st.failWrite = fail
+			err := tr.observe(t.Context(), snap, outages)
+			st.failCommit = false
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("snapshot %d: got error %v, want injected failure", i, err)
+			}
+			failures++
+
+			if d := cmp.Diff(known, tr.known, allow); d != "" {
+				t.Fatalf("snapshot %d failing write %d: known mismatch (-before +after):\n%s", i, fail, d)
+			}
+			if d := cmp.Diff(resolved, tr.resolved, allow); d != "" {
+				t.Fatalf("snapshot %d failing write %d: resolved mismatch (-before +after):\n%s", i, fail, d)
+			}
+			if d := cmp.Diff(events, st.events); d != "" {
+				t.Fatalf("snapshot %d failing write %d: events mismatch (-before +after):\n%s", i, fail, d)
+			}
+			if d := cmp.Diff(links, st.links); d != "" {
+				t.Fatalf("snapshot %d failing write %d: links mismatch (-before +after):\n%s", i, fail, d)
+			}
+		}
+	}
+
+	if d := cmp.Diff(clean.events, st.events); d != "" {
+		t.Errorf("events mismatch (-clean +failed and retried):\n%s", d)
+	}
+	if d := cmp.Diff(clean.links, st.links); d != "" {
+		t.Errorf("links mismatch (-clean +failed and retried):\n%s", d)
+	}
+	if d := cmp.Diff(cleanTr.known, tr.known, allow); d != "" {
+		t.Errorf("known mismatch (-clean +failed and retried):\n%s", d)
+	}
+	if len(clean.links) != 1 || failures < 10 {
+		t.Errorf("got %d links and %d failures, test isn't exercising enough", len(clean.links), failures)
+	}
+}
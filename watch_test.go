@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ingests int
+	err := watch(ctx, time.Millisecond, func(ctx context.Context) error {
+		ingests++
+		if ingests == 3 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if ingests != 3 {
+		t.Errorf("got %d ingests, want 3", ingests)
+	}
+
+	// Errors are retried, until ctx is done.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ingests = 0
+	err = watch(ctx, time.Millisecond, func(ctx context.Context) error {
+		ingests++
+		if ingests == 3 {
+			cancel()
+			return ctx.Err()
+		}
+		return errors.New("ingest failed")
+	})
+	if !errors.Is(err, context.Canceled) || ingests != 3 {
+		t.Errorf("got error %v after %d ingests, want context.Canceled after 3", err, ingests)
+	}
+}